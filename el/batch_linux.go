@@ -0,0 +1,109 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// batched udp socket I/O with recvmmsg/sendmmsg
+
+package el
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// both ipv4.PacketConn and ipv6.PacketConn, their Message is the same type
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type batchConn struct {
+	conn  *net.UDPConn
+	pc    batchPacketConn
+	rmsgs []ipv4.Message
+	wmsgs []ipv4.Message
+}
+
+func newBatchConn(conn *net.UDPConn) *batchConn {
+	c := new(batchConn)
+	c.conn = conn
+	if laddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && laddr.IP.To4() == nil {
+		c.pc = ipv6.NewPacketConn(conn)
+	} else {
+		c.pc = ipv4.NewPacketConn(conn)
+	}
+	c.rmsgs = make([]ipv4.Message, UDP_BATCH_SIZE)
+	c.wmsgs = make([]ipv4.Message, UDP_BATCH_SIZE)
+	for i := range c.rmsgs {
+		c.rmsgs[i].Buffers = [][]byte{getBuffer()}
+		c.wmsgs[i].Buffers = make([][]byte, 1)
+	}
+	return c
+}
+
+// read up to len(packets) datagrams with one syscall, the data
+// buffers are pooled and handed over to the caller
+func (c *batchConn) readBatch(packets []*udpPacket) (int, error) {
+	if len(packets) > len(c.rmsgs) {
+		packets = packets[:len(c.rmsgs)]
+	}
+	n, err := c.pc.ReadBatch(c.rmsgs[:len(packets)], 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		m := &c.rmsgs[i]
+		packets[i].data = m.Buffers[0][:m.N]
+		packets[i].addr, _ = m.Addr.(*net.UDPAddr)
+		m.Buffers[0] = getBuffer()
+	}
+	return n, nil
+}
+
+// send packets with as few syscalls as possible, returns how many went
+// and the first error of the ones that didn't
+func (c *batchConn) writeBatch(packets []*udpPacket) (int, error) {
+	if len(packets) > len(c.wmsgs) {
+		packets = packets[:len(c.wmsgs)]
+	}
+	for i, packet := range packets {
+		c.wmsgs[i].Buffers[0] = packet.data
+		c.wmsgs[i].Addr = packet.addr
+	}
+	msgs := c.wmsgs[:len(packets)]
+	sent := 0
+	var firstErr error
+	for i := 0; i < len(msgs); {
+		n, err := c.pc.WriteBatch(msgs[i:], 0)
+		sent += n
+		i += n
+		if err == nil && n == 0 {
+			err = errors.New("sendmmsg sent nothing")
+		}
+		if err != nil {
+			// the one that failed is skipped, the rest still go
+			if firstErr == nil {
+				firstErr = err
+			}
+			i++
+		}
+	}
+	return sent, firstErr
+}
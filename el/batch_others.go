@@ -0,0 +1,62 @@
+//go:build !linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// one datagram per syscall where recvmmsg/sendmmsg aren't available
+
+package el
+
+import (
+	"net"
+)
+
+type batchConn struct {
+	conn *net.UDPConn
+}
+
+func newBatchConn(conn *net.UDPConn) *batchConn {
+	return &batchConn{conn}
+}
+
+func (c *batchConn) readBatch(packets []*udpPacket) (int, error) {
+	buf := getBuffer()
+	n, addr, err := c.conn.ReadFromUDP(buf)
+	if err != nil {
+		putBuffer(buf)
+		return 0, err
+	}
+	packets[0].data = buf[:n]
+	packets[0].addr = addr
+	return 1, nil
+}
+
+func (c *batchConn) writeBatch(packets []*udpPacket) (int, error) {
+	sent := 0
+	var firstErr error
+	for _, packet := range packets {
+		if _, err := c.conn.WriteToUDP(packet.data, packet.addr); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, firstErr
+}
@@ -29,37 +29,56 @@ import (
 )
 
 type elPacketBuffer struct {
-	buf       *bufferList
-	rate      int32
-	mutex     sync.Mutex
-	flushChan chan *ElPacket
-	newPack   chan struct{}
+	buf     *bufferList
+	rate    int32
+	mutex   sync.Mutex
+	flush   func(*ElPacket)
+	newPack chan struct{}
+	dropped uint64
 }
 
 var bufFull = errors.New("Buffer Full")
 
-func newElPacketBuffer(flushChan chan *ElPacket) *elPacketBuffer {
+// packets are handed to flush in order, flush must not block
+func newElPacketBuffer(flush func(*ElPacket), size int) *elPacketBuffer {
+	if size <= 0 {
+		size = QUEUE_DEFAULT_LEN
+	}
 	hb := new(elPacketBuffer)
 	hb.buf = newBufferList()
-	hb.flushChan = flushChan
-	hb.newPack = make(chan struct{}, 9184)
+	hb.flush = flush
+	hb.newPack = make(chan struct{}, size)
 	go func() {
 		for {
 			p := hb.Pop()
 			if p != nil {
-				hb.flushChan <- p
+				hb.flush(p)
 			}
 		}
 	}()
 	return hb
 }
 
+// Push never blocks, packets beyond the buffer size are dropped
 func (hb *elPacketBuffer) Push(p *ElPacket) {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+
 	atomic.AddInt32(&hb.rate, 1)
+	// every queued token has its packet still in the list,
+	// so there's always room for a token when the list has room
+	if hb.buf.Len() >= cap(hb.newPack) {
+		atomic.AddUint64(&hb.dropped, 1)
+		return
+	}
 	hb.buf.Push(int64(p.Seq), p)
 	hb.newPack <- struct{}{}
 }
 
+func (hb *elPacketBuffer) Dropped() uint64 {
+	return atomic.LoadUint64(&hb.dropped)
+}
+
 func (hb *elPacketBuffer) Pop() *ElPacket {
 	<-hb.newPack
 	r := int(hb.rate & 0x10)
@@ -129,6 +148,12 @@ func (l *bufferList) Push(key int64, p interface{}) {
 	l.count++
 }
 
+func (l *bufferList) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.count
+}
+
 func (l *bufferList) Pop() interface{} {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
@@ -44,21 +44,30 @@ func newElCipher(key []byte) (*elCipher, error) {
 	return s, nil
 }
 
+// encrypt msg into a pooled buffer, which is the caller's to put back
 func (s *elCipher) encrypt(msg []byte) []byte {
-	cmsg := make([]byte, snappy.MaxEncodedLen(len(msg)))
-	cmsg = snappy.Encode(cmsg, msg)
+	cbuf := getBufferSize(snappy.MaxEncodedLen(len(msg)))
+	defer putBuffer(cbuf)
+	cmsg := snappy.Encode(cbuf, msg)
 
-	pmsg := PKCS5Padding(cmsg, cipherBlockSize)
-	buf := make([]byte, len(pmsg)+cipherBlockSize)
+	padding := cipherBlockSize - len(cmsg)%cipherBlockSize
+	buf := getBufferSize(cipherBlockSize + len(cmsg) + padding)
 
 	iv := buf[:cipherBlockSize]
 	rand.Read(iv)
+	// PKCS5 padding in place
+	pmsg := buf[cipherBlockSize:]
+	copy(pmsg, cmsg)
+	for i := len(cmsg); i < len(pmsg); i++ {
+		pmsg[i] = byte(padding)
+	}
 	encrypter := _cipher.NewCBCEncrypter(s.block, iv)
-	encrypter.CryptBlocks(buf[cipherBlockSize:], pmsg)
+	encrypter.CryptBlocks(pmsg, pmsg)
 
 	return buf
 }
 
+// decrypt ctext into a pooled buffer, which is the caller's to put back
 func (s *elCipher) decrypt(iv []byte, ctext []byte) []byte {
 	defer func() {
 		if err := recover(); err != nil {
@@ -66,11 +75,19 @@ func (s *elCipher) decrypt(iv []byte, ctext []byte) []byte {
 		}
 	}()
 	decrypter := _cipher.NewCBCDecrypter(s.block, iv)
-	buf := make([]byte, len(ctext))
+	buf := getBufferSize(len(ctext))
+	defer putBuffer(buf)
 	decrypter.CryptBlocks(buf, ctext)
 	cmsg := PKCS5UnPadding(buf)
 
-	msg, _ := snappy.Decode(nil, cmsg)
+	n, err := snappy.DecodedLen(cmsg)
+	if err != nil {
+		return nil
+	}
+	msg, err := snappy.Decode(getBufferSize(n), cmsg)
+	if err != nil {
+		return nil
+	}
 	return msg
 }
 
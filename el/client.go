@@ -27,16 +27,18 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/songgao/water"
 )
 
 var net_gateway, net_nic string
 
+// ipv6 default route, empty if there is none
+var net_gateway6, net_nic6 string
+
 type route struct {
 	dest, nextEl, iface string
 }
@@ -45,29 +47,62 @@ type ElClient struct {
 	// config
 	cfg ElClientConfig
 	// interface
-	iface *water.Interface
+	iface tunDevice
+	// all queues of the interface, iface is the first one
+	queues []tunDevice
 	// ip addr
 	ip net.IP
+	// ipv6 addr, nil if the server didn't assign one
+	ip6 net.IP
+	// ethernet frames over a tap device
+	tap bool
+	// p2p or subnet
+	topology int
+	// heartbeat interval in seconds
+	heartbeat int32
+	// server addresses, one per family
+	srvIPs []net.IP
+	// dns servers and search domains, configured or pushed
+	dns     []net.IP
+	domains []string
+	// nil until the system resolver is pointed at the tunnel
+	resolver dnsBackend
+	// nil without firewall rules to set up
+	fw firewall
+	// fix the mss of syns through the device ourselves
+	clampMSS bool
 
 	// session id
 	sid [4]byte
 	// session state
 	state int32
 
-	// net to interface
-	toIface chan *ElPacket
+	// net to interface, one queue per device queue
+	toIface []*elQueue
 	// buffer for packets from net
 	recvBuf *elPacketBuffer
-	// channel to send frames to net
-	toNet chan *ElPacket
+	// queue to send frames to net
+	toNet *elQueue
 
 	handshakeDone  chan struct{}
 	handshakeError chan struct{}
 	finishAck      chan byte
 	// state variable to ensure serverRoute added
-	srvRoute int32
-	// routes need to be clean in the end
-	routes []string
+	srvRoute  int32
+	srvRoute6 int32
+	// bypass-routes and include-routes
+	routeSets []*elRouteSet
+	// bypass-domains and include-domains
+	splitDNS *elSplitDNS
+	// mark of our udp sockets and table of the tunnel default route
+	// with redirect-mode fwmark, 0 otherwise
+	fwmark int
+	table  int
+	// mark of our udp sockets, fwmark or the kill switch's
+	sockMark int
+	// set when the server finished the session, the kill switch
+	// stays then
+	keepKillSwitch int32
 	// sequence number
 	seq uint32
 }
@@ -85,18 +120,109 @@ func NewClient(cfg ElClientConfig) error {
 		MTU = cfg.MTU
 	}
 
+	policy, err := parseDropPolicy(cfg.Drop_policy)
+	if err != nil {
+		return err
+	}
+	tap, err := parseDevType(cfg.Dev_type)
+	if err != nil {
+		return err
+	}
+	topology, err := parseTopology(cfg.Topology)
+	if err != nil {
+		return err
+	}
+	redirectMode, err := parseRedirectMode(cfg.Redirect_mode)
+	if err != nil {
+		return err
+	}
+	mssClamp, err := parseMSSClamp(cfg.Mss_clamp)
+	if err != nil {
+		return err
+	}
+	qlen := cfg.QueueLen
+	if qlen <= 0 {
+		qlen = 128
+	}
+
+	nqueues := cfg.Queues
+	if nqueues <= 0 {
+		nqueues = 1
+	}
+
 	elClient := new(ElClient)
 	rand.Read(elClient.sid[:])
-	elClient.toIface = make(chan *ElPacket, 128)
-	elClient.toNet = make(chan *ElPacket, 128)
-	elClient.recvBuf = newElPacketBuffer(elClient.toIface)
+	elClient.toIface = make([]*elQueue, nqueues)
+	for idx := range elClient.toIface {
+		elClient.toIface[idx] = newElQueue(fmt.Sprintf("toIface[%d]", idx), qlen, policy)
+	}
+	elClient.toNet = newElQueue("toNet", qlen, policy)
+	elClient.recvBuf = newElPacketBuffer(elClient.toDevice, qlen)
 	elClient.cfg = cfg
+	elClient.tap = tap
+	elClient.topology = topology
+	elClient.clampMSS = cfg.FixMSS && mssClamp == MSS_CLAMP_PROCESS
+	if redirectMode == REDIRECT_FWMARK {
+		elClient.fwmark, elClient.table = cfg.Fwmark, cfg.Route_table
+		if elClient.fwmark <= 0 {
+			elClient.fwmark = FWMARK_DEFAULT
+		}
+		if elClient.table <= 0 {
+			elClient.table = elClient.fwmark
+		}
+	}
+	// the kill switch lets only marked packets to the server
+	elClient.sockMark = elClient.fwmark
+	if cfg.Kill_switch && elClient.sockMark == 0 {
+		elClient.sockMark = cfg.Fwmark
+		if elClient.sockMark <= 0 {
+			elClient.sockMark = FWMARK_DEFAULT
+		}
+	}
+	elClient.heartbeat = int32(cfg.Heartbeat_interval)
+	if elClient.heartbeat <= 0 {
+		elClient.heartbeat = 30
+	}
 	elClient.state = HOP_STAT_INIT
 	elClient.handshakeDone = make(chan struct{})
 	elClient.handshakeError = make(chan struct{})
 	elClient.finishAck = make(chan byte)
 	elClient.srvRoute = 0
-	elClient.routes = make([]string, 0, 1024)
+	for _, s := range cfg.Dns {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid dns server %s", s)
+		}
+		elClient.dns = append(elClient.dns, ip)
+	}
+	elClient.domains = cfg.Dns_domain
+	resolver, err := newDNSBackend(cfg.Dns_backend)
+	if err != nil {
+		return err
+	}
+	bypass, err := loadRouteLists(cfg.Bypass_routes)
+	if err != nil {
+		return err
+	}
+	include, err := loadRouteLists(cfg.Include_routes)
+	if err != nil {
+		return err
+	}
+	// before split dns reads the system's nameservers
+	recoverDNS()
+	splitDNS, err := newElSplitDNS(cfg)
+	if err != nil {
+		return err
+	}
+	killSwitchAllow, err := parseKillSwitchAllow(cfg.Kill_switch_allow)
+	if err != nil {
+		return err
+	}
+	// addresses of bypassed names are only known once they're asked
+	// for, the kill switch would drop them
+	if cfg.Kill_switch && len(cfg.Bypass_domains) > 0 {
+		return errors.New("kill-switch can't be used with bypass-domains")
+	}
 
 	switch cfg.MorphMethod {
 	case "randsize":
@@ -110,11 +236,13 @@ func NewClient(cfg ElClientConfig) error {
 
 	go elClient.cleanUp()
 
-	iface, err := newTun("")
+	queues, err := newTunQueues("", tap, nqueues, cfg.Offload)
 	if err != nil {
 		return err
 	}
+	iface := queues[0]
 	elClient.iface = iface
+	elClient.queues = queues
 
 	net_gateway, net_nic, err = getNetGateway()
 	logger.Debug("Net Gateway: %s %s", net_gateway, net_nic)
@@ -122,9 +250,47 @@ func NewClient(cfg ElClientConfig) error {
 		return err
 	}
 
-	for port := cfg.HopStart; port <= cfg.HopEnd; port++ {
-		server := fmt.Sprintf("%s:%d", cfg.Server, port)
-		go elClient.handleUDP(server)
+	net_gateway6, net_nic6, err = getNetGateway6()
+	if err != nil {
+		logger.Debug("No IPv6 Net Gateway: %s", err.Error())
+	}
+
+	// up before the first packet to the server, and left up by a
+	// client that dies so nothing leaks until it's back. the one
+	// left up only lets the resolvers through until the server is
+	// looked up again.
+	var killSwitch *elKillSwitch
+	if cfg.Kill_switch {
+		killSwitch = &elKillSwitch{
+			iface:     iface.Name(),
+			hopStart:  cfg.HopStart,
+			hopEnd:    cfg.HopEnd,
+			mark:      elClient.sockMark,
+			allow:     killSwitchAllow,
+			bypass:    bypass,
+			resolvers: systemNameservers(),
+		}
+		if err = killSwitch.enable(); err != nil {
+			return err
+		}
+	}
+	// hop over the ports of every address family the server has
+	srvIPs, err := lookupServer(cfg.Server)
+	if err != nil {
+		return err
+	}
+	elClient.srvIPs = srvIPs
+	if killSwitch != nil {
+		killSwitch.servers, killSwitch.resolvers = srvIPs, nil
+		if err = killSwitch.enable(); err != nil {
+			return err
+		}
+	}
+	for _, srvIP := range srvIPs {
+		for port := cfg.HopStart; port <= cfg.HopEnd; port++ {
+			server := net.JoinHostPort(srvIP.String(), strconv.Itoa(port))
+			go elClient.handleUDP(server)
+		}
 	}
 
 	// wait until handshake done
@@ -142,13 +308,29 @@ wait_handshake:
 		}
 	}
 
+	// the system resolver asks the split dns forwarder, which asks
+	// the tunnel's dns servers
+	if splitDNS != nil {
+		ip, err := splitDNS.start(elClient)
+		if err != nil {
+			return err
+		}
+		elClient.splitDNS = splitDNS
+		elClient.dns = []net.IP{ip}
+	}
+	if resolver != nil && (len(elClient.dns) > 0 || len(elClient.domains) > 0) {
+		elClient.setDNS(resolver)
+	}
+
 	routeDone := make(chan bool)
 	go func() {
 		for _, dest := range cfg.Net_gateway {
-			addRoute(dest, net_gateway, net_nic)
-			elClient.routes = append(elClient.routes, dest)
+			if err := addRoute(dest, net_gateway, net_nic); err != nil {
+				logger.Warning(err.Error())
+			}
 		}
-		if cfg.Redirect_gateway {
+		elClient.addRouteLists(bypass, include)
+		if elClient.cfg.Redirect_gateway {
 			routeDone <- true
 		}
 	}()
@@ -166,14 +348,39 @@ wait_handshake:
 		cmd.Run()
 	}
 
-	if cfg.Redirect_gateway {
+	// the server may have pushed the policy in the handshake
+	if elClient.cfg.Redirect_gateway {
 		go func() {
 			<-routeDone
-			err = redirectGateway(iface.Name(), tun_peer.String())
+			if elClient.fwmark != 0 {
+				err := redirectGatewayMark(iface.Name(), tun_peer, false, elClient.fwmark, elClient.table)
+				if err != nil {
+					logger.Error(err.Error())
+					return
+				}
+				if elClient.ip6 != nil {
+					err = redirectGatewayMark(iface.Name(), nil, true, elClient.fwmark, elClient.table)
+					if err != nil {
+						logger.Error(err.Error())
+					}
+				}
+				return
+			}
+
+			gw := ""
+			if tun_peer != nil {
+				gw = tun_peer.String()
+			}
+			err = redirectGateway(iface.Name(), gw)
 			if err != nil {
 				logger.Error(err.Error())
 				return
 			}
+			if elClient.ip6 != nil {
+				if err = redirectGateway6(iface.Name()); err != nil {
+					logger.Error(err.Error())
+				}
+			}
 		}()
 	}
 
@@ -183,35 +390,83 @@ wait_handshake:
 }
 
 func (clt *ElClient) handleInterface() {
-	// network packet to interface
-	go func() {
-		for {
-			hp := <-clt.toIface
-			// logger.Debug("New Net packet to device")
-			_, err := clt.iface.Write(hp.payload)
-			// logger.Debug("n: %d, len: %d", n, len(hp.payload))
-			if err != nil {
-				logger.Error(err.Error())
-				return
+	// every device queue is read and written on its own
+	for idx := range clt.queues {
+		go clt.writeIface(idx)
+	}
+	for idx := 1; idx < len(clt.queues); idx++ {
+		go clt.readIface(idx)
+	}
+	clt.readIface(0)
+}
+
+// network packet to interface
+func (clt *ElClient) writeIface(idx int) {
+	iface := clt.queues[idx]
+	q := clt.toIface[idx]
+	hps := make([]*ElPacket, 0, IFACE_BATCH_SIZE)
+	frames := make([][]byte, 0, IFACE_BATCH_SIZE)
+	for {
+		// block for the first packet, then take whatever
+		// else is queued up to a batch
+		hps = append(hps[:0], q.Pop().(*ElPacket))
+		for len(hps) < IFACE_BATCH_SIZE {
+			hp, ok := q.TryPop()
+			if !ok {
+				break
 			}
+			hps = append(hps, hp.(*ElPacket))
 		}
-	}()
+		frames = frames[:0]
+		for _, hp := range hps {
+			if clt.clampMSS {
+				clampMSS(ipFrame(hp.payload, clt.tap))
+			}
+			frames = append(frames, hp.payload)
+		}
+		// logger.Debug("New Net packets to device")
+		err := writeFrames(iface, frames)
+		for _, hp := range hps {
+			hp.release()
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+}
 
-	frame := make([]byte, IFACE_BUFSIZE)
+// queue a packet to the device, packets of the same flow
+// always go through the same device queue
+func (clt *ElClient) toDevice(hp *ElPacket) {
+	frame := hp.payload
+	if clt.tap {
+		frame = ethPayload(frame)
+	}
+	idx := int(flowHash(frame) % uint32(len(clt.toIface)))
+	clt.toIface[idx].Push(0, hp)
+}
+
+func (clt *ElClient) readIface(idx int) {
+	iface := clt.queues[idx]
 	for {
-		n, err := clt.iface.Read(frame)
+		// read right behind the room left for the header
+		buf := getBuffer()
+		n, err := iface.Read(buf[HOP_HDR_LEN:])
 		if err != nil {
 			logger.Error(err.Error())
 			return
 		}
 
-		buf := make([]byte, n+HOP_HDR_LEN)
-		copy(buf[HOP_HDR_LEN:], frame[:n])
 		hp := new(ElPacket)
-		hp.payload = buf[HOP_HDR_LEN:]
-		hp.buf = buf
+		hp.buf = buf[:n+HOP_HDR_LEN]
+		hp.payload = hp.buf[HOP_HDR_LEN:]
+		hp.pooled = true
+		if clt.clampMSS {
+			clampMSS(ipFrame(hp.payload, clt.tap))
+		}
 		hp.Seq = clt.Seq()
-		clt.toNet <- hp
+		clt.toNet.Push(0, hp)
 		/*
 		   if elFrager == nil {
 		       // if no traffic morphing
@@ -230,7 +485,11 @@ func (clt *ElClient) handleInterface() {
 
 func (clt *ElClient) handleUDP(server string) {
 	udpAddr, _ := net.ResolveUDPAddr("udp", server)
-	udpConn, _ := net.DialUDP("udp", nil, udpAddr)
+	udpConn, err := dialUDP(udpAddr, clt.sockMark)
+	if err != nil {
+		logger.Error("dial %s: %v", server, err)
+		return
+	}
 
 	logger.Debug(udpConn.RemoteAddr().String())
 
@@ -262,14 +521,9 @@ func (clt *ElClient) handleUDP(server string) {
 	}()
 
 	go func() {
-		var intval time.Duration
-
-		if clt.cfg.Heartbeat_interval <= 0 {
-			intval = time.Second * 30
-		} else {
-			intval = time.Second * time.Duration(clt.cfg.Heartbeat_interval)
-		}
 		for {
+			// the server may push an interval of its own
+			intval := time.Second * time.Duration(atomic.LoadInt32(&clt.heartbeat))
 			time.Sleep(intval)
 			if clt.state == HOP_STAT_WORKING {
 				clt.knock(udpConn)
@@ -279,28 +533,24 @@ func (clt *ElClient) handleUDP(server string) {
 
 	// add route through net gateway
 	if clt.cfg.Redirect_gateway && (!clt.cfg.Local) {
-		if atomic.CompareAndSwapInt32(&clt.srvRoute, 0, 1) {
-			if udpAddr, ok := udpConn.RemoteAddr().(*net.UDPAddr); ok {
-				srvIP := udpAddr.IP.To4()
-				if srvIP != nil {
-					srvDest := srvIP.String() + "/32"
-					addRoute(srvDest, net_gateway, net_nic)
-					clt.routes = append(clt.routes, srvDest)
-				}
-			}
+		if udpAddr, ok := udpConn.RemoteAddr().(*net.UDPAddr); ok {
+			clt.addServerRoute(udpAddr.IP)
 		}
 	}
 
 	// forward iface frames to network
 	go func() {
 		for {
-			hp := <-clt.toNet
+			hp := clt.toNet.Pop().(*ElPacket)
 			hp.setSid(clt.sid)
 			// logger.Debug("New iface frame")
 			// dest := waterutil.IPv4Destination(frame)
 			// logger.Debug("ip dest: %v", dest)
 
-			udpConn.Write(hp.Pack())
+			data := hp.Pack()
+			udpConn.Write(data)
+			putBuffer(data)
+			hp.release()
 		}
 	}()
 
@@ -324,7 +574,62 @@ func (clt *ElClient) handleUDP(server string) {
 		} else {
 			logger.Error("Unkown flag: %x", hp.Flag)
 		}
+		// data packets are released once written to the device
+		if hp.Flag&^HOP_FLG_MFR != HOP_FLG_DAT {
+			hp.release()
+		}
+	}
+}
+
+// keep the server reachable through the net gateway
+// once the default route goes through the tunnel
+func (clt *ElClient) addServerRoute(srvIP net.IP) {
+	// marked packets skip the tunnel table
+	if clt.fwmark != 0 {
+		return
+	}
+	if ip4 := srvIP.To4(); ip4 != nil {
+		if atomic.CompareAndSwapInt32(&clt.srvRoute, 0, 1) {
+			if err := addRoute(ip4.String(), net_gateway, net_nic); err != nil {
+				logger.Warning(err.Error())
+			}
+		}
+	} else if net_gateway6 != "" {
+		if atomic.CompareAndSwapInt32(&clt.srvRoute6, 0, 1) {
+			if err := addRoute(srvIP.String(), net_gateway6, net_nic6); err != nil {
+				logger.Warning(err.Error())
+			}
+		}
+	}
+}
+
+// resolve the server to at most one address per family
+func lookupServer(server string) ([]net.IP, error) {
+	ips, err := net.LookupIP(server)
+	if err != nil {
+		return nil, err
+	}
+	var ip4, ip6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if ip4 == nil {
+				ip4 = ip
+			}
+		} else if ip6 == nil {
+			ip6 = ip
+		}
 	}
+	srvIPs := make([]net.IP, 0, 2)
+	if ip4 != nil {
+		srvIPs = append(srvIPs, ip4)
+	}
+	if ip6 != nil {
+		srvIPs = append(srvIPs, ip6)
+	}
+	if len(srvIPs) == 0 {
+		return nil, fmt.Errorf("no address found for %s", server)
+	}
+	return srvIPs, nil
 }
 
 func (clt *ElClient) Seq() uint32 {
@@ -339,7 +644,9 @@ func (clt *ElClient) toServer(u *net.UDPConn, flag byte, payload []byte, noise b
 	if noise {
 		hp.addNoise(mrand.Intn(MTU - 64 - len(payload)))
 	}
-	u.Write(hp.Pack())
+	data := hp.Pack()
+	u.Write(data)
+	putBuffer(data)
 }
 
 // knock server port or heartbeat
@@ -354,7 +661,10 @@ func (clt *ElClient) handeshake(u *net.UDPConn) {
 
 	if res {
 		logger.Info("start handeshaking")
-		clt.toServer(u, HOP_FLG_HSH, clt.sid[:], true)
+		// the name goes behind the session id, for the server
+		// to find the subnets routed to us
+		payload := append(clt.sid[:], []byte(clt.cfg.Name)...)
+		clt.toServer(u, HOP_FLG_HSH, payload, true)
 	}
 }
 
@@ -362,13 +672,15 @@ func (clt *ElClient) handeshake(u *net.UDPConn) {
 func (clt *ElClient) finishSession() {
 	logger.Info("Finishing Session")
 	atomic.StoreInt32(&clt.state, HOP_STAT_FIN)
-	hp := new(ElPacket)
-	hp.Flag = HOP_FLG_FIN
-	hp.setPayload(clt.sid[:])
-	hp.Seq = clt.Seq()
-	clt.toNet <- hp
-	clt.toNet <- hp
-	clt.toNet <- hp
+	seq := clt.Seq()
+	// packets are released once sent, so each copy is its own
+	for i := 0; i < 3; i++ {
+		hp := new(ElPacket)
+		hp.Flag = HOP_FLG_FIN
+		hp.setPayload(clt.sid[:])
+		hp.Seq = seq
+		clt.toNet.Push(0, hp)
+	}
 }
 
 // heartbeat ack
@@ -395,11 +707,8 @@ func (clt *ElClient) handleHandshakeAck(u *net.UDPConn, hp *ElPacket) {
 		ipStr := fmt.Sprintf("%d.%d.%d.%d/%d", by[0], by[1], by[2], by[3], by[4])
 
 		ip, subnet, _ := net.ParseCIDR(ipStr)
-
-		setTunIP(clt.iface, ip, subnet)
-		if clt.cfg.FixMSS {
-			fixMSS(clt.iface.Name(), false)
-		}
+		clt.applyOptions(ip, subnet, parseOptions(hp.payload[6:]))
+		clt.setFirewall()
 		res := atomic.CompareAndSwapInt32(&clt.state, HOP_STAT_HANDSHAKE, HOP_STAT_WORKING)
 		if !res {
 			logger.Error("Client state not expected: %d", clt.state)
@@ -412,6 +721,126 @@ func (clt *ElClient) handleHandshakeAck(u *net.UDPConn, hp *ElPacket) {
 	clt.toServer(u, HOP_FLG_HSH|HOP_FLG_ACK, clt.sid[:], true)
 }
 
+// set up the device and routes with what the server pushed
+func (clt *ElClient) applyOptions(ip net.IP, subnet *net.IPNet, opts *elOptions) {
+	if opts.topology >= 0 {
+		clt.topology = opts.topology
+	}
+	if opts.mtu > 0 && opts.mtu != MTU {
+		if err := setMTU(clt.iface, opts.mtu); err != nil {
+			logger.Error("set mtu: %v", err)
+		} else {
+			MTU = opts.mtu
+		}
+	}
+
+	if clt.tap || clt.topology == TOPOLOGY_SUBNET {
+		if err := setSubnetIP(clt.iface, ip, subnet); err != nil {
+			logger.Error("set address: %v", err)
+		}
+		// there is no peer address, route via the server
+		tun_peer = opts.gateway
+	} else if err := setTunIP(clt.iface, ip, subnet); err != nil {
+		logger.Error("set address: %v", err)
+	}
+
+	if opts.ip6 != nil {
+		subnet6 := &net.IPNet{IP: opts.ip6.IP.Mask(opts.ip6.Mask), Mask: opts.ip6.Mask}
+		if err := setTunIP6(clt.iface, opts.ip6.IP, subnet6); err != nil {
+			logger.Error("set ipv6 address: %v", err)
+		} else {
+			clt.ip6 = opts.ip6.IP
+		}
+	}
+
+	if opts.heartbeat > 0 {
+		atomic.StoreInt32(&clt.heartbeat, int32(opts.heartbeat))
+	}
+	if opts.redirect != nil && *opts.redirect != clt.cfg.Redirect_gateway {
+		logger.Info("server sets redirect-gateway to %v", *opts.redirect)
+		clt.cfg.Redirect_gateway = *opts.redirect
+		if clt.cfg.Redirect_gateway && !clt.cfg.Local {
+			for _, srvIP := range clt.srvIPs {
+				clt.addServerRoute(srvIP)
+			}
+		}
+	}
+
+	for _, route := range opts.routes {
+		// ipv6 is on link
+		gw := tun_peer
+		if route.IP.To4() == nil {
+			gw = nil
+		}
+		if err := addRouteVia(route, gw, clt.iface.Name()); err != nil {
+			logger.Warning("route %s: %v", route, err)
+		}
+	}
+
+	if len(opts.dns) > 0 || len(opts.domains) > 0 {
+		logger.Info("server pushed dns %v, search %v", opts.dns, opts.domains)
+	}
+	// the client's own config wins
+	if len(clt.cfg.Dns) == 0 {
+		clt.dns = opts.dns
+	}
+	if len(clt.cfg.Dns_domain) == 0 {
+		clt.domains = opts.domains
+	}
+}
+
+// clamp the mss of syns to the tunnel mtu the server may have pushed
+// with mss-clamp firewall, flushing what a previous run left
+func (clt *ElClient) setFirewall() {
+	var rules []fwRule
+	if clt.cfg.FixMSS && !clt.clampMSS {
+		rules = mssRules(clt.iface.Name(), false, clt.ip6 != nil)
+	}
+	fw, err := setupFirewall(clt.cfg.Firewall, "client", rules)
+	if err != nil {
+		logger.Error("firewall: %v", err)
+		return
+	}
+	clt.fw = fw
+}
+
+// point the system resolver at the tunnel, with redirect-gateway every
+// query goes to the tunnel's dns servers
+func (clt *ElClient) setDNS(resolver dnsBackend) {
+	err := resolver.apply(clt.iface.Name(), clt.dns, clt.domains, clt.cfg.Redirect_gateway)
+	if err != nil {
+		logger.Error("set dns: %v", err)
+	}
+	// a half applied config is undone too
+	clt.resolver = resolver
+}
+
+// bypass routes go via the gateway the client found at start, include
+// routes into the tunnel
+func (clt *ElClient) addRouteLists(bypass, include []*net.IPNet) {
+	bypass4, bypass6 := splitFamilies(bypass)
+	include4, include6 := splitFamilies(include)
+	if len(bypass6) > 0 && net_gateway6 == "" {
+		logger.Warning("no ipv6 gateway, %d bypass routes left out", len(bypass6))
+		bypass6 = nil
+	}
+	if len(include6) > 0 && clt.ip6 == nil {
+		logger.Warning("no ipv6 in the tunnel, %d include routes left out", len(include6))
+		include6 = nil
+	}
+
+	sets := []*elRouteSet{
+		{bypass4, net.ParseIP(net_gateway), net_nic},
+		{bypass6, net.ParseIP(net_gateway6), net_nic6},
+		{include4, tun_peer, clt.iface.Name()},
+		{include6, nil, clt.iface.Name()},
+	}
+	for _, set := range sets {
+		set.install()
+	}
+	clt.routeSets = sets
+}
+
 // handle handshake fail
 func (clt *ElClient) handleHandshakeError(u *net.UDPConn, hp *ElPacket) {
 	close(clt.handshakeError)
@@ -431,6 +860,10 @@ func (clt *ElClient) handleFinishAck(u *net.UDPConn, hp *ElPacket) {
 // handle finish
 func (clt *ElClient) handleFinish(u *net.UDPConn, hp *ElPacket) {
 	logger.Info("Finish")
+	if clt.cfg.Kill_switch {
+		logger.Warning("kill switch stays on until elvpn -disconnect")
+		atomic.StoreInt32(&clt.keepKillSwitch, 1)
+	}
 	pid := os.Getpid()
 	syscall.Kill(pid, syscall.SIGTERM)
 }
@@ -441,9 +874,13 @@ func (clt *ElClient) cleanUp() {
 	<-c
 	logger.Info("Cleaning Up")
 
-	if clt.cfg.Redirect_gateway {
+	if clt.cfg.Redirect_gateway && clt.fwmark == 0 {
 		delRoute("0.0.0.0/1")
 		delRoute("128.0.0.0/1")
+		if clt.ip6 != nil {
+			delRoute("::/1")
+			delRoute("8000::/1")
+		}
 	}
 
 	// Pre Down
@@ -459,8 +896,16 @@ func (clt *ElClient) cleanUp() {
 		cmd.Run()
 	}
 
-	if clt.cfg.FixMSS {
-		clearMSS(clt.iface.Name(), false)
+	if clt.fw != nil {
+		if err := clt.fw.flush(); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+
+	if clt.resolver != nil {
+		if err := clt.resolver.restore(); err != nil {
+			logger.Error("restore dns: %v", err)
+		}
 	}
 
 	timeout := time.After(3 * time.Second)
@@ -475,8 +920,19 @@ func (clt *ElClient) cleanUp() {
 		logger.Info("Timeout, give up")
 	}
 
-	for _, dest := range clt.routes {
-		delRoute(dest)
+	// whatever else was changed over netlink
+	rtnl.rollback()
+	for _, set := range clt.routeSets {
+		set.remove()
+	}
+	if clt.splitDNS != nil {
+		clt.splitDNS.cleanUp()
+	}
+	// the user disconnects, not the server
+	if clt.cfg.Kill_switch && atomic.LoadInt32(&clt.keepKillSwitch) == 0 {
+		if err := DisableKillSwitch(); err != nil {
+			logger.Error(err.Error())
+		}
 	}
 
 	os.Exit(0)
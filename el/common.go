@@ -28,4 +28,10 @@ var MTU = 1400
 
 const (
 	IFACE_BUFSIZE = 2000
+	// ethernet header in front of tap frames
+	ETH_HDR_LEN = 14
+	// max datagrams per recvmmsg/sendmmsg
+	UDP_BATCH_SIZE = 32
+	// max frames per write to the tun device
+	IFACE_BATCH_SIZE = 64
 )
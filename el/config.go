@@ -12,6 +12,7 @@ type ElServerConfig struct {
 	HopEnd      int
 	ListenAddr  string
 	Addr        string
+	Addr6       string
 	MTU         int
 	Key         string
 	FixMSS      bool
@@ -19,6 +20,58 @@ type ElServerConfig struct {
 	PeerTimeout int
 	Up          string
 	Down        string
+	// length of each packet queue and what to drop when it's full
+	QueueLen    int
+	Drop_policy string
+	// number of decryption workers, defaults to GOMAXPROCS
+	Workers int
+	// number of SO_REUSEPORT sockets per hop port
+	Sockets int
+	// number of tun queues
+	Queues int
+	// let the tun device hand over TSO/USO super packets
+	Offload bool
+	// tun or tap, and the bridge a tap device is attached to
+	Dev_type string
+	Bridge   string
+	// p2p or subnet
+	Topology string
+	// client configuration pushed in the handshake
+	Push_route            []string
+	Push_dns              []string
+	Push_domain           []string
+	Push_heartbeat        int
+	Push_redirect_gateway string
+	// kernel, direct or deny
+	Client_to_client string
+	// address ranges handed out to clients, first-last
+	Pool_range []string
+	// state file keeping leases across restarts, and how long
+	// a gone client's lease lasts in seconds
+	Lease_file string
+	Lease_time int
+	// subnets behind clients, by client name, from the iroute sections
+	Iroutes map[string]*ElIrouteConfig
+	// static addresses by client name, from the reservation sections
+	Reservations map[string]string
+	// interface to masquerade the tunnel subnets out of
+	Nat string
+	// auto, nftables, iptables, iptables-nft or iptables-legacy
+	Firewall string
+	// how fixmss clamps, process or firewall
+	Mss_clamp string
+}
+
+// static address of the client named in the section,
+// [reservation "branch1"]
+type ElReservationConfig struct {
+	Addr string
+}
+
+// subnets routed to the client named in the section,
+// [iroute "branch1"]
+type ElIrouteConfig struct {
+	Subnet []string
 }
 
 // Client Config
@@ -36,14 +89,47 @@ type ElClientConfig struct {
 	Up                 string
 	Down               string
 	Heartbeat_interval int
+	QueueLen           int
+	Drop_policy        string
+	Queues             int
+	Offload            bool
+	Dev_type           string
+	Topology           string
+	// name the server knows this client by, for its iroutes
+	Name string
+	// override what the server pushes
+	Dns         []string
+	Dns_domain  []string
+	Dns_backend string
+	// CIDR list files routed around or through the tunnel
+	Bypass_routes  []string
+	Include_routes []string
+	// domain list files, and the local forwarder that routes them
+	Bypass_domains     []string
+	Include_domains    []string
+	Split_dns_listen   string
+	Split_dns_upstream string
+	// routes or fwmark, and the mark and table of the latter
+	Redirect_mode string
+	Fwmark        int
+	Route_table   int
+	// block all traffic outside the tunnel but to these prefixes
+	Kill_switch       bool
+	Kill_switch_allow []string
+	// auto, nftables, iptables, iptables-nft or iptables-legacy
+	Firewall string
+	// how fixmss clamps, process or firewall
+	Mss_clamp string
 }
 
 type ElConfig struct {
 	Default struct {
 		Mode string
 	}
-	Server ElServerConfig
-	Client ElClientConfig
+	Server      ElServerConfig
+	Client      ElClientConfig
+	Iroute      map[string]*ElIrouteConfig
+	Reservation map[string]*ElReservationConfig
 }
 
 func ParseElConfig(filename string) (interface{}, error) {
@@ -54,8 +140,18 @@ func ParseElConfig(filename string) (interface{}, error) {
 	}
 	switch cfg.Default.Mode {
 	case "server":
+		cfg.Server.Iroutes = cfg.Iroute
+		cfg.Server.Reservations = make(map[string]string)
+		for name, r := range cfg.Reservation {
+			if r != nil {
+				cfg.Server.Reservations[name] = r.Addr
+			}
+		}
 		return cfg.Server, nil
 	case "client":
+		if err = checkSplitDNSListen(cfg.Client.Split_dns_listen); err != nil {
+			return nil, err
+		}
 		return cfg.Client, nil
 	default:
 		return nil, errors.New("Wrong mode")
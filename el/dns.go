@@ -0,0 +1,209 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// client dns servers and search domains
+
+package el
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	RESOLV_CONF        = "/etc/resolv.conf"
+	RESOLV_CONF_BACKUP = "/etc/resolv.conf.elvpn"
+	// the uplink servers systemd-resolved knows of
+	RESOLVED_RESOLV_CONF = "/run/systemd/resolve/resolv.conf"
+
+	RESOLVED_DEST = "org.freedesktop.resolve1"
+	RESOLVED_PATH = "/org/freedesktop/resolve1"
+)
+
+var invalidDNSBackend = errors.New("Invalid dns backend")
+
+// dnsBackend points the system resolver at the tunnel
+type dnsBackend interface {
+	apply(iface string, servers []net.IP, domains []string, defaultRoute bool) error
+	restore() error
+}
+
+// auto picks systemd-resolved if it's running, resolv.conf otherwise
+func newDNSBackend(name string) (dnsBackend, error) {
+	switch name {
+	case "", "auto":
+		if r, err := newResolvedDNS(); err == nil {
+			return r, nil
+		} else {
+			logger.Debug("systemd-resolved unavailable: %v", err)
+		}
+		return new(resolvConfDNS), nil
+	case "resolved":
+		return newResolvedDNS()
+	case "resolvconf":
+		return new(resolvConfDNS), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, invalidDNSBackend
+	}
+}
+
+// put back a resolv.conf a crashed client left behind, systemd-resolved
+// forgets about a link on its own once the device is gone
+func recoverDNS() {
+	if _, err := os.Lstat(RESOLV_CONF_BACKUP); err != nil {
+		return
+	}
+	logger.Warning("restoring %s left over from a previous run", RESOLV_CONF)
+	if err := new(resolvConfDNS).restore(); err != nil {
+		logger.Error("restoring %s: %v", RESOLV_CONF, err)
+	}
+}
+
+// systemd-resolved, configured per link over D-Bus
+type resolvedDNS struct {
+	conn  *dbus.Conn
+	index int32
+}
+
+func newResolvedDNS() (*resolvedDNS, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	var running bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, RESOLVED_DEST).Store(&running)
+	if err != nil {
+		return nil, err
+	}
+	if !running {
+		return nil, errors.New("not running")
+	}
+	r := new(resolvedDNS)
+	r.conn = conn
+	return r, nil
+}
+
+func (r *resolvedDNS) call(method string, args ...interface{}) error {
+	obj := r.conn.Object(RESOLVED_DEST, RESOLVED_PATH)
+	return obj.Call(RESOLVED_DEST+".Manager."+method, 0, args...).Err
+}
+
+func (r *resolvedDNS) apply(iface string, servers []net.IP, domains []string, defaultRoute bool) error {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	r.index = int32(link.Index)
+
+	type linkDNS struct {
+		Family  int32
+		Address []byte
+	}
+	type linkDomain struct {
+		Domain    string
+		RouteOnly bool
+	}
+	addrs := make([]linkDNS, 0, len(servers))
+	for _, ip := range servers {
+		if ip4 := ip.To4(); ip4 != nil {
+			addrs = append(addrs, linkDNS{syscall.AF_INET, []byte(ip4)})
+		} else {
+			addrs = append(addrs, linkDNS{syscall.AF_INET6, []byte(ip.To16())})
+		}
+	}
+	doms := make([]linkDomain, 0, len(domains)+1)
+	for _, d := range domains {
+		doms = append(doms, linkDomain{d, false})
+	}
+	// every query goes through the tunnel, none leaks
+	// to the other links
+	if defaultRoute {
+		doms = append(doms, linkDomain{".", true})
+	}
+
+	logger.Info("systemd-resolved: dns %v, domains %v on %s", servers, domains, iface)
+	if err = r.call("SetLinkDNS", r.index, addrs); err != nil {
+		return err
+	}
+	if err = r.call("SetLinkDomains", r.index, doms); err != nil {
+		return err
+	}
+	return r.call("SetLinkDefaultRoute", r.index, defaultRoute)
+}
+
+func (r *resolvedDNS) restore() error {
+	if r.index == 0 {
+		return nil
+	}
+	logger.Info("systemd-resolved: reverting link %d", r.index)
+	return r.call("RevertLink", r.index)
+}
+
+// rewrite /etc/resolv.conf, the original one (or the symlink it is)
+// is moved aside and moved back on restore
+type resolvConfDNS struct{}
+
+func (r *resolvConfDNS) apply(iface string, servers []net.IP, domains []string, defaultRoute bool) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# generated by elvpn for %s, the original is %s\n", iface, RESOLV_CONF_BACKUP)
+	for _, ip := range servers {
+		fmt.Fprintf(buf, "nameserver %s\n", ip)
+	}
+	// search domains alone keep the nameservers there are
+	if len(servers) == 0 {
+		orig, err := os.ReadFile(RESOLV_CONF)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(orig), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && (fields[0] == "nameserver" || fields[0] == "options") {
+				buf.WriteString(line + "\n")
+			}
+		}
+	}
+	if len(domains) > 0 {
+		buf.WriteString("search")
+		for _, d := range domains {
+			buf.WriteString(" " + d)
+		}
+		buf.WriteString("\n")
+	}
+
+	if err := os.Rename(RESOLV_CONF, RESOLV_CONF_BACKUP); err != nil {
+		return err
+	}
+	logger.Info("%s: dns %v, domains %v", RESOLV_CONF, servers, domains)
+	return os.WriteFile(RESOLV_CONF, buf.Bytes(), 0644)
+}
+
+func (r *resolvConfDNS) restore() error {
+	if _, err := os.Lstat(RESOLV_CONF_BACKUP); err != nil {
+		return nil
+	}
+	logger.Info("restoring %s", RESOLV_CONF)
+	return os.Rename(RESOLV_CONF_BACKUP, RESOLV_CONF)
+}
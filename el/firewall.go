@@ -0,0 +1,349 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// firewall rules elvpn keeps, through nftables or either iptables
+
+package el
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const (
+	FW_MASQUERADE int = iota // src masqueraded out of iface
+	FW_MSS                   // mss of tcp syns forwarded in or out of iface
+)
+
+// one rule, in terms every backend can write
+type fwRule struct {
+	kind int
+	// 4 or 6
+	family int
+	iface  string
+	// the rule matches packets coming in from iface, not going out
+	in  bool
+	src *net.IPNet
+	mss int
+}
+
+// mss clamping of the syns forwarded through iface, to fit the tunnel,
+// ipv6 ones only if the tunnel carries ipv6 so hosts without ip6tables
+// do fine
+func mssRules(iface string, in, v6 bool) []fwRule {
+	rules := []fwRule{{kind: FW_MSS, family: 4, iface: iface, in: in, mss: mssLimit(false)}}
+	if v6 {
+		rules = append(rules, fwRule{kind: FW_MSS, family: 6, iface: iface, in: in, mss: mssLimit(true)})
+	}
+	return rules
+}
+
+func masqueradeRule(src *net.IPNet, iface string) fwRule {
+	family := 4
+	if src.IP.To4() == nil {
+		family = 6
+	}
+	return fwRule{kind: FW_MASQUERADE, family: family, iface: iface, src: src}
+}
+
+// firewall keeps all the rules elvpn has in a table or chains of its
+// own, apply replaces them in one go and flush drops them all, whatever
+// a run before that got killed left behind
+type firewall interface {
+	name() string
+	// what apply runs, for -dry-run
+	script(rules []fwRule) string
+	apply(rules []fwRule) error
+	flush() error
+}
+
+var invalidFirewall = errors.New("Invalid firewall")
+
+// the backend of the given name, auto picks nftables if nft works and
+// iptables, in whichever flavour it is, otherwise. owner tells apart
+// the rules of a server and a client on the same host.
+func newFirewall(name, owner string) (firewall, error) {
+	switch name {
+	case "", "auto":
+		if hasNft() {
+			return newNftFirewall(owner), nil
+		}
+		if _, err := exec.LookPath("iptables"); err == nil {
+			return newIptablesFirewall("", owner), nil
+		}
+		return nil, errors.New("neither nft nor iptables found")
+	case "nftables":
+		return newNftFirewall(owner), nil
+	case "iptables", "iptables-nft", "iptables-legacy":
+		return newIptablesFirewall(strings.TrimPrefix(strings.TrimPrefix(name, "iptables"), "-"), owner), nil
+	default:
+		return nil, invalidFirewall
+	}
+}
+
+// set up rules, with nothing to set up the leftovers of a run before
+// are flushed still, returns nil then
+func setupFirewall(name, owner string, rules []fwRule) (firewall, error) {
+	fw, err := newFirewall(name, owner)
+	if err != nil {
+		if len(rules) == 0 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(rules) == 0 {
+		if err = fw.flush(); err != nil {
+			logger.Debug("flush %s: %v", fw.name(), err)
+		}
+		return nil, nil
+	}
+	logger.Info("%d firewall rules with %s", len(rules), fw.name())
+	if err = fw.apply(rules); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// nft works, not just installed
+func hasNft() bool {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false
+	}
+	return exec.Command("nft", "list", "tables").Run() == nil
+}
+
+// load an nft script, all of it or nothing
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// native nftables, a table of our own that's replaced as a whole
+type nftFirewall struct {
+	table string
+}
+
+func newNftFirewall(owner string) *nftFirewall {
+	return &nftFirewall{"inet elvpn_" + owner}
+}
+
+func (f *nftFirewall) name() string {
+	return "nftables"
+}
+
+func (f *nftFirewall) ruleset(rules []fwRule) string {
+	buf := new(bytes.Buffer)
+	// creating the table first makes deleting it never fail
+	fmt.Fprintf(buf, "table %s\ndelete table %s\n", f.table, f.table)
+	fmt.Fprintf(buf, "table %s {\n", f.table)
+
+	buf.WriteString("\tchain forward {\n")
+	buf.WriteString("\t\ttype filter hook forward priority mangle; policy accept;\n")
+	for _, r := range rules {
+		if r.kind != FW_MSS {
+			continue
+		}
+		dir := "oifname"
+		if r.in {
+			dir = "iifname"
+		}
+		proto := "ipv4"
+		if r.family == 6 {
+			proto = "ipv6"
+		}
+		fmt.Fprintf(buf, "\t\tmeta nfproto %s %s %q tcp flags & (syn | rst) == syn tcp option maxseg size set %d\n",
+			proto, dir, r.iface, r.mss)
+	}
+	buf.WriteString("\t}\n")
+
+	buf.WriteString("\tchain postrouting {\n")
+	buf.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	for _, r := range rules {
+		if r.kind != FW_MASQUERADE {
+			continue
+		}
+		family := "ip"
+		if r.family == 6 {
+			family = "ip6"
+		}
+		fmt.Fprintf(buf, "\t\t%s saddr %s oifname %q masquerade\n", family, r.src, r.iface)
+	}
+	buf.WriteString("\t}\n}\n")
+	return buf.String()
+}
+
+func (f *nftFirewall) script(rules []fwRule) string {
+	return fmt.Sprintf("nft -f - <<EOF\n%sEOF\n", f.ruleset(rules))
+}
+
+func (f *nftFirewall) apply(rules []fwRule) error {
+	return runNft(f.ruleset(rules))
+}
+
+func (f *nftFirewall) flush() error {
+	return runNft(fmt.Sprintf("table %s\ndelete table %s\n", f.table, f.table))
+}
+
+// iptables, legacy or nft flavoured, rules in chains of our own that
+// the built in chains jump to, iptables-restore replaces them per table
+// in one commit
+type iptablesFirewall struct {
+	// legacy, nft or "" for whatever iptables is
+	flavour string
+	prefix  string
+}
+
+// table, built in chain, and our chain it jumps to
+type iptablesHook struct {
+	table, builtin, chain string
+}
+
+func newIptablesFirewall(flavour, owner string) *iptablesFirewall {
+	return &iptablesFirewall{flavour, "ELVPN-" + strings.ToUpper(owner) + "-"}
+}
+
+func (f *iptablesFirewall) name() string {
+	if f.flavour == "" {
+		return "iptables"
+	}
+	return "iptables-" + f.flavour
+}
+
+// iptables or ip6tables of our flavour, with a suffix like -restore
+func (f *iptablesFirewall) cmd(family int, suffix string) string {
+	cmd := "iptables"
+	if family == 6 {
+		cmd = "ip6tables"
+	}
+	if f.flavour != "" {
+		cmd += "-" + f.flavour
+	}
+	return cmd + suffix
+}
+
+func (f *iptablesFirewall) hooks() []iptablesHook {
+	return []iptablesHook{
+		{"mangle", "FORWARD", f.prefix + "FORWARD"},
+		{"nat", "POSTROUTING", f.prefix + "POSTROUTING"},
+	}
+}
+
+// the iptables-restore input of a family, declaring a chain flushes it
+func (f *iptablesFirewall) restore(family int, rules []fwRule) string {
+	buf := new(bytes.Buffer)
+	for _, hook := range f.hooks() {
+		fmt.Fprintf(buf, "*%s\n:%s - [0:0]\n", hook.table, hook.chain)
+		for _, r := range rules {
+			if r.family != family {
+				continue
+			}
+			switch {
+			case r.kind == FW_MSS && hook.table == "mangle":
+				dir := "-o"
+				if r.in {
+					dir = "-i"
+				}
+				fmt.Fprintf(buf, "-A %s %s %s -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss %d\n",
+					hook.chain, dir, r.iface, r.mss)
+			case r.kind == FW_MASQUERADE && hook.table == "nat":
+				fmt.Fprintf(buf, "-A %s -s %s -o %s -j MASQUERADE\n", hook.chain, r.src, r.iface)
+			}
+		}
+		buf.WriteString("COMMIT\n")
+	}
+	return buf.String()
+}
+
+func (f *iptablesFirewall) script(rules []fwRule) string {
+	buf := new(bytes.Buffer)
+	for _, family := range []int{4, 6} {
+		fmt.Fprintf(buf, "%s --noflush <<EOF\n%sEOF\n", f.cmd(family, "-restore"), f.restore(family, rules))
+		for _, hook := range f.hooks() {
+			fmt.Fprintf(buf, "%s -t %s -I %s -j %s\n", f.cmd(family, ""), hook.table, hook.builtin, hook.chain)
+		}
+	}
+	return buf.String()
+}
+
+func (f *iptablesFirewall) run(family int, args ...string) error {
+	cmd := f.cmd(family, "")
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", cmd, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) apply(rules []fwRule) error {
+	for _, family := range []int{4, 6} {
+		cmd := exec.Command(f.cmd(family, "-restore"), "--noflush")
+		cmd.Stdin = strings.NewReader(f.restore(family, rules))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			err = fmt.Errorf("%s: %v: %s", cmd.Path, err, bytes.TrimSpace(out))
+			if family == 6 && !hasFamily(rules, 6) {
+				// no ipv6 rules to miss
+				logger.Debug(err.Error())
+				continue
+			}
+			return err
+		}
+		// jump to our chains once, the jumps of a run before stay
+		for _, hook := range f.hooks() {
+			if f.run(family, "-t", hook.table, "-C", hook.builtin, "-j", hook.chain) == nil {
+				continue
+			}
+			if err := f.run(family, "-t", hook.table, "-I", hook.builtin, "-j", hook.chain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) flush() error {
+	var firstErr error
+	for _, family := range []int{4, 6} {
+		for _, hook := range f.hooks() {
+			for f.run(family, "-t", hook.table, "-D", hook.builtin, "-j", hook.chain) == nil {
+			}
+			f.run(family, "-t", hook.table, "-F", hook.chain)
+			if err := f.run(family, "-t", hook.table, "-X", hook.chain); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func hasFamily(rules []fwRule, family int) bool {
+	for _, r := range rules {
+		if r.family == family {
+			return true
+		}
+	}
+	return false
+}
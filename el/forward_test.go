@@ -0,0 +1,114 @@
+package el
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+// run with -cpu 1,2,4,8 to see how forwarding scales with GOMAXPROCS
+
+const benchPeers = 64
+
+func newBenchServer(b *testing.B, qlen int) *ElServer {
+	logging.SetLevel(logging.ERROR, "elvpn")
+
+	var err error
+	cipher, err = newElCipher([]byte("benchmark"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	srv := new(ElServer)
+	srv.cfg.QueueLen = qlen
+	srv.sessionTable = make(map[uint64]*ElPeer)
+	srv.routes = newElRouteTable()
+	srv.toIface = []*elQueue{newElQueue("toIface", qlen, QUEUE_DROP_TAIL)}
+	srv.toNet = []*elQueue{newElQueue("toNet", qlen, QUEUE_DROP_TAIL)}
+	srv.fromNet = make([]*elQueue, runtime.GOMAXPROCS(0))
+	for idx := range srv.fromNet {
+		srv.fromNet[idx] = newElQueue(fmt.Sprintf("fromNet[%d]", idx), qlen, QUEUE_DROP_TAIL)
+	}
+	return srv
+}
+
+func benchAddr(i int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 40100}
+}
+
+func BenchmarkDecryptWorkers(b *testing.B) {
+	srv := newBenchServer(b, b.N+1)
+
+	var wg sync.WaitGroup
+	count := func(u *udpPacket, hp *ElPacket) {
+		wg.Done()
+	}
+	srv.pktHandle = map[byte](func(*udpPacket, *ElPacket)){
+		HOP_FLG_DAT: count,
+	}
+
+	packets := make([]*udpPacket, benchPeers)
+	for i := range packets {
+		hp := new(ElPacket)
+		hp.Flag = HOP_FLG_DAT
+		hp.Seq = uint32(i)
+		hp.setPayload(make([]byte, MTU))
+		packets[i] = &udpPacket{benchAddr(i), hp.Pack(), 0}
+	}
+
+	for _, q := range srv.fromNet {
+		go srv.decryptWorker(q)
+	}
+
+	b.SetBytes(int64(MTU))
+	b.ResetTimer()
+	wg.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		// the worker puts the data back into the pool, like
+		// the buffers readBatch hands over
+		p := packets[i%benchPeers]
+		data := getBuffer()[:len(p.data)]
+		copy(data, p.data)
+		srv.dispatch(&udpPacket{p.addr, data, p.channel})
+	}
+	wg.Wait()
+}
+
+func BenchmarkPeerEncrypt(b *testing.B) {
+	srv := newBenchServer(b, b.N+1)
+	// only the shared socket queue is unbounded, peers keep their limit
+	srv.cfg.QueueLen = 1024
+
+	peers := make([]*ElPeer, benchPeers)
+	for i := range peers {
+		peers[i] = newElPeer(uint64(i+1)<<32, srv, benchAddr(i), 0)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < b.N; i++ {
+			srv.toNet[0].Pop()
+		}
+		close(done)
+	}()
+
+	b.SetBytes(int64(MTU))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hpeer := peers[i%benchPeers]
+		pack := make([]byte, MTU+HOP_HDR_LEN)
+		for !hpeer.fromIface.Push(hpeer.id, pack) {
+			runtime.Gosched()
+		}
+	}
+	<-done
+	b.StopTimer()
+
+	for _, hpeer := range peers {
+		hpeer.stop()
+	}
+}
@@ -0,0 +1,345 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// Segmentation and coalescing of tun super packets (GSO/GRO)
+
+package el
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	VNET_HDR_LEN = 10
+
+	VNET_HDR_F_NEEDS_CSUM uint8 = 1
+
+	VNET_HDR_GSO_NONE   uint8 = 0
+	VNET_HDR_GSO_TCPV4  uint8 = 1
+	VNET_HDR_GSO_UDP    uint8 = 3
+	VNET_HDR_GSO_TCPV6  uint8 = 4
+	VNET_HDR_GSO_UDP_L4 uint8 = 5
+	VNET_HDR_GSO_ECN    uint8 = 0x80
+
+	// largest super packet the kernel hands over or accepts
+	GSO_MAX_SIZE = 65535
+
+	IPPROTO_TCP = 6
+	IPPROTO_UDP = 17
+
+	TCP_FLG_FIN = 0x01
+	TCP_FLG_SYN = 0x02
+	TCP_FLG_RST = 0x04
+	TCP_FLG_PSH = 0x08
+	TCP_FLG_ACK = 0x10
+	TCP_FLG_CWR = 0x80
+)
+
+var badGSOPacket = errors.New("Malformed GSO packet")
+
+// struct virtio_net_hdr, in host byte order
+type vnetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *vnetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:4])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:6])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:8])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:10])
+}
+
+func (h *vnetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:4], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:6], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:8], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:10], h.csumOffset)
+}
+
+// ones' complement sum of b, added to sum
+func csumAdd(sum uint32, b []byte) uint32 {
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n%2 == 1 {
+		sum += uint32(b[n-1]) << 8
+	}
+	return sum
+}
+
+func csumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// sum of the tcp/udp pseudo header of ip packet pkt
+func pseudoSum(pkt []byte, proto byte, l4len int) uint32 {
+	var sum uint32
+	if pkt[0]>>4 == 4 {
+		sum = csumAdd(0, pkt[12:20])
+	} else {
+		sum = csumAdd(0, pkt[8:40])
+	}
+	return sum + uint32(proto) + uint32(l4len)
+}
+
+func ipv4HeaderChecksum(pkt []byte) {
+	ihl := int(pkt[0]&0x0f) * 4
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:12], ^csumFold(csumAdd(0, pkt[:ihl])))
+}
+
+// recompute the tcp or udp checksum of pkt, l4 starting at l4off
+func l4Checksum(pkt []byte, proto byte, l4off int) {
+	field := l4off + 16
+	if proto == IPPROTO_UDP {
+		field = l4off + 6
+	}
+	pkt[field], pkt[field+1] = 0, 0
+	sum := pseudoSum(pkt, proto, len(pkt)-l4off)
+	csum := ^csumFold(csumAdd(sum, pkt[l4off:]))
+	if csum == 0 && proto == IPPROTO_UDP {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(pkt[field:field+2], csum)
+}
+
+// complete a partial checksum the kernel left for us to finish
+func completeChecksum(pkt []byte, h *vnetHdr) error {
+	start, field := int(h.csumStart), int(h.csumStart+h.csumOffset)
+	if field+2 > len(pkt) || start > len(pkt) {
+		return badGSOPacket
+	}
+	// the field already holds the pseudo header sum
+	csum := ^csumFold(csumAdd(0, pkt[start:]))
+	binary.BigEndian.PutUint16(pkt[field:field+2], csum)
+	return nil
+}
+
+// split a super packet into segments of at most gsoSize payload bytes,
+// every segment gets its own headers and checksums and is appended to
+// segs in a pooled buffer
+func gsoSplit(pkt []byte, h *vnetHdr, segs [][]byte) ([][]byte, error) {
+	l4off := int(h.csumStart)
+	gso := int(h.gsoSize)
+	if l4off < 20 || gso == 0 || len(pkt) < l4off+8 {
+		return segs, badGSOPacket
+	}
+
+	var proto byte
+	var hdrLen int
+	switch h.gsoType &^ VNET_HDR_GSO_ECN {
+	case VNET_HDR_GSO_TCPV4, VNET_HDR_GSO_TCPV6:
+		if len(pkt) < l4off+20 {
+			return segs, badGSOPacket
+		}
+		proto = IPPROTO_TCP
+		hdrLen = l4off + int(pkt[l4off+12]>>4)*4
+	case VNET_HDR_GSO_UDP_L4:
+		proto = IPPROTO_UDP
+		hdrLen = l4off + 8
+	default:
+		return segs, badGSOPacket
+	}
+	if hdrLen > len(pkt) {
+		return segs, badGSOPacket
+	}
+
+	v4 := pkt[0]>>4 == 4
+	payload := pkt[hdrLen:]
+	seq := binary.BigEndian.Uint32(pkt[l4off+4 : l4off+8])
+	id := binary.BigEndian.Uint16(pkt[4:6])
+
+	for i, off := 0, 0; off < len(payload); i, off = i+1, off+gso {
+		end := off + gso
+		last := end >= len(payload)
+		if last {
+			end = len(payload)
+		}
+
+		seg := getBufferSize(hdrLen + end - off)
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[off:end])
+
+		if v4 {
+			binary.BigEndian.PutUint16(seg[2:4], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:6], id+uint16(i))
+			ipv4HeaderChecksum(seg)
+		} else {
+			binary.BigEndian.PutUint16(seg[4:6], uint16(len(seg)-40))
+		}
+
+		if proto == IPPROTO_TCP {
+			binary.BigEndian.PutUint32(seg[l4off+4:l4off+8], seq+uint32(off))
+			if !last {
+				seg[l4off+13] &^= TCP_FLG_FIN | TCP_FLG_PSH
+			}
+			if i > 0 {
+				seg[l4off+13] &^= TCP_FLG_CWR
+			}
+		} else {
+			binary.BigEndian.PutUint16(seg[l4off+4:l4off+6], uint16(len(seg)-l4off))
+		}
+		l4Checksum(seg, proto, l4off)
+
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// a super packet to write, its parts are written back to back after
+// the vnet header
+type groPacket struct {
+	hdr   vnetHdr
+	parts [][]byte
+}
+
+// offsets of a tcp segment that may be coalesced, ok is false otherwise
+func groTCPInfo(pkt []byte) (l4off, hdrLen int, ok bool) {
+	if len(pkt) < 40 {
+		return 0, 0, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		// no ip options, not a fragment
+		if pkt[0]&0x0f != 5 || pkt[9] != IPPROTO_TCP ||
+			binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 {
+			return 0, 0, false
+		}
+		l4off = 20
+	case 6:
+		if pkt[6] != IPPROTO_TCP || len(pkt) < 60 {
+			return 0, 0, false
+		}
+		l4off = 40
+	default:
+		return 0, 0, false
+	}
+	hdrLen = l4off + int(pkt[l4off+12]>>4)*4
+	if hdrLen >= len(pkt) || pkt[l4off+13]&^(TCP_FLG_ACK|TCP_FLG_PSH) != 0 {
+		return 0, 0, false
+	}
+	return l4off, hdrLen, true
+}
+
+// whether b follows a in the same tcp flow with the same headers
+func groFollows(a []byte, l4off, hdrLen int, nextSeq uint32, b []byte) bool {
+	bl4, bhdr, ok := groTCPInfo(b)
+	if !ok || bl4 != l4off || bhdr != hdrLen {
+		return false
+	}
+	if a[0]>>4 == 4 {
+		// addresses, ports and everything up to the flags
+		if string(a[12:20]) != string(b[12:20]) {
+			return false
+		}
+	} else if string(a[8:40]) != string(b[8:40]) {
+		return false
+	}
+	if string(a[l4off:l4off+4]) != string(b[l4off:l4off+4]) ||
+		binary.BigEndian.Uint32(b[l4off+4:l4off+8]) != nextSeq ||
+		string(a[l4off+8:l4off+12]) != string(b[l4off+8:l4off+12]) ||
+		string(a[l4off+14:l4off+16]) != string(b[l4off+14:l4off+16]) ||
+		string(a[l4off+20:hdrLen]) != string(b[l4off+20:hdrLen]) {
+		return false
+	}
+	return true
+}
+
+// merge consecutive segments of the same tcp flow into super packets,
+// anything else is passed through as is. The first packet of a merged
+// group gets its headers rewritten in place.
+func groCoalesce(pkts [][]byte, out []groPacket) []groPacket {
+	for i := 0; i < len(pkts); {
+		p := pkts[i]
+		l4off, hdrLen, ok := groTCPInfo(p)
+		if !ok {
+			out = append(out, groPacket{parts: [][]byte{p}})
+			i++
+			continue
+		}
+
+		gso := len(p) - hdrLen
+		total := len(p)
+		nextSeq := binary.BigEndian.Uint32(p[l4off+4:l4off+8]) + uint32(gso)
+		parts := [][]byte{p}
+		psh := p[l4off+13]&TCP_FLG_PSH != 0
+
+		j := i + 1
+		for ; j < len(pkts) && !psh; j++ {
+			q := pkts[j]
+			plen := len(q) - hdrLen
+			if plen <= 0 || plen > gso || total+plen > GSO_MAX_SIZE ||
+				!groFollows(p, l4off, hdrLen, nextSeq, q) {
+				break
+			}
+			parts = append(parts, q[hdrLen:])
+			total += plen
+			nextSeq += uint32(plen)
+			psh = q[l4off+13]&TCP_FLG_PSH != 0
+			if plen < gso {
+				j++
+				break
+			}
+		}
+
+		if len(parts) == 1 {
+			out = append(out, groPacket{parts: parts})
+			i++
+			continue
+		}
+
+		gp := groPacket{parts: parts}
+		gp.hdr.flags = VNET_HDR_F_NEEDS_CSUM
+		gp.hdr.hdrLen = uint16(hdrLen)
+		gp.hdr.gsoSize = uint16(gso)
+		gp.hdr.csumStart = uint16(l4off)
+		gp.hdr.csumOffset = 16
+		if p[0]>>4 == 4 {
+			gp.hdr.gsoType = VNET_HDR_GSO_TCPV4
+			binary.BigEndian.PutUint16(p[2:4], uint16(total))
+			ipv4HeaderChecksum(p)
+		} else {
+			gp.hdr.gsoType = VNET_HDR_GSO_TCPV6
+			binary.BigEndian.PutUint16(p[4:6], uint16(total-40))
+		}
+		if psh {
+			p[l4off+13] |= TCP_FLG_PSH
+		}
+		// the kernel finishes the checksum from the pseudo header sum
+		binary.BigEndian.PutUint16(p[l4off+16:l4off+18],
+			csumFold(pseudoSum(p, IPPROTO_TCP, total-l4off)))
+
+		out = append(out, gp)
+		i = j
+	}
+	return out
+}
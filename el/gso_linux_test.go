@@ -0,0 +1,190 @@
+package el
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/op/go-logging"
+	"golang.org/x/sys/unix"
+)
+
+// one end of a tunnel over loopback, packets read from the device
+// are encrypted and sent to the other end, what comes from there is
+// decrypted and written to the device
+type loopEnd struct {
+	iface tunDevice
+	conn  *net.UDPConn
+	peer  *net.UDPAddr
+}
+
+func (e *loopEnd) toNet() {
+	buf := make([]byte, IFACE_BUFSIZE)
+	for {
+		n, err := e.iface.Read(buf)
+		if err != nil {
+			return
+		}
+		hp := &ElPacket{payload: buf[:n]}
+		hp.Flag = HOP_FLG_DAT
+		pack := hp.Pack()
+		e.conn.WriteToUDP(pack, e.peer)
+		putBuffer(pack)
+	}
+}
+
+func (e *loopEnd) toDevice() {
+	bc := newBatchConn(e.conn)
+	packets := make([]*udpPacket, UDP_BATCH_SIZE)
+	for i := range packets {
+		packets[i] = new(udpPacket)
+	}
+	hps := make([]*ElPacket, 0, UDP_BATCH_SIZE)
+	frames := make([][]byte, 0, UDP_BATCH_SIZE)
+	for {
+		n, err := bc.readBatch(packets)
+		if err != nil {
+			return
+		}
+		hps, frames = hps[:0], frames[:0]
+		for _, u := range packets[:n] {
+			if hp, err := unpackElPacket(u.data); err == nil {
+				hps = append(hps, hp)
+				frames = append(frames, hp.payload)
+			}
+			putBuffer(u.data)
+		}
+		err = writeFrames(e.iface, frames)
+		for _, hp := range hps {
+			hp.release()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func ipCmd(b *testing.B, args ...string) {
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		b.Fatalf("ip %v: %v %s", args, err, out)
+	}
+}
+
+// listen in network namespace ns, the socket stays there
+func listenIn(ns string, addr string) (net.Listener, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	self, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		return nil, err
+	}
+	defer self.Close()
+	target, err := os.Open("/var/run/netns/" + ns)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	if err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		return nil, err
+	}
+	defer unix.Setns(int(self.Fd()), unix.CLONE_NEWNET)
+	return net.Listen("tcp", addr)
+}
+
+// a tcp stream through two tun devices and elvpn's encryption over
+// loopback, the receiving device sits in a namespace of its own so
+// the kernel can't short cut it. Needs root, run with
+// go test -run NONE -bench TunnelLoopback
+func BenchmarkTunnelLoopback(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("needs root for the tun devices")
+	}
+	for _, offload := range []bool{false, true} {
+		b.Run(fmt.Sprintf("offload=%v", offload), func(b *testing.B) {
+			benchTunnelLoopback(b, offload)
+		})
+	}
+}
+
+func benchTunnelLoopback(b *testing.B, offload bool) {
+	logging.SetLevel(logging.ERROR, "elvpn")
+	var err error
+	if cipher, err = newElCipher([]byte("loopback")); err != nil {
+		b.Fatal(err)
+	}
+
+	ns := fmt.Sprintf("elbench%d", os.Getpid())
+	ipCmd(b, "netns", "add", ns)
+	defer exec.Command("ip", "netns", "del", ns).Run()
+
+	var ends [2]*loopEnd
+	for i := range ends {
+		queues, err := newTunQueues("", false, 1, offload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer queues[0].Close()
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		ends[i] = &loopEnd{iface: queues[0], conn: conn}
+	}
+	ends[0].peer = ends[1].conn.LocalAddr().(*net.UDPAddr)
+	ends[1].peer = ends[0].conn.LocalAddr().(*net.UDPAddr)
+
+	a, z := ends[0].iface.Name(), ends[1].iface.Name()
+	ipCmd(b, "addr", "add", "10.203.0.1/24", "dev", a)
+	ipCmd(b, "link", "set", z, "netns", ns)
+	ipCmd(b, "-n", ns, "addr", "add", "10.203.0.2/24", "dev", z)
+	ipCmd(b, "-n", ns, "link", "set", z, "mtu", fmt.Sprint(MTU), "up")
+	// deleting the devices wakes up their readers
+	defer exec.Command("ip", "link", "del", a).Run()
+	defer exec.Command("ip", "-n", ns, "link", "del", z).Run()
+
+	for _, e := range ends {
+		go e.toNet()
+		go e.toDevice()
+	}
+
+	ln, err := listenIn(ns, "10.203.0.2:5201")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan int64, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		n, _ := io.Copy(io.Discard, c)
+		c.Close()
+		received <- n
+	}()
+
+	c, err := net.Dial("tcp", "10.203.0.2:5201")
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunk := make([]byte, GSO_MAX_SIZE)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	c.Close()
+	if n := <-received; n != int64(b.N*len(chunk)) {
+		b.Fatalf("received %d of %d bytes", n, b.N*len(chunk))
+	}
+}
@@ -51,3 +51,60 @@ func randAddr(a []*hUDPAddr) *hUDPAddr {
 	i := rand.Intn(len(a))
 	return a[i]
 }
+
+const FNV32_OFFSET uint32 = 2166136261
+
+// FNV-1a hash of b, continued from h
+func fnv32(h uint32, b []byte) uint32 {
+	for _, c := range b {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return h
+}
+
+// the ip packet an ethernet frame carries
+func ethPayload(frame []byte) []byte {
+	if len(frame) < ETH_HDR_LEN {
+		return nil
+	}
+	return frame[ETH_HDR_LEN:]
+}
+
+func ipv6Destination(frame []byte) net.IP {
+	return net.IP(frame[24:40])
+}
+
+// hash of an ip packet's destination address
+func destHash(frame []byte) uint64 {
+	switch {
+	case len(frame) >= 20 && frame[0]>>4 == 4:
+		return ip4_uint64(frame[16:20])
+	case len(frame) >= 40 && frame[0]>>4 == 6:
+		return uint64(fnv32(FNV32_OFFSET, frame[24:40]))
+	}
+	return 0
+}
+
+// hash of an ip packet's flow: addresses, protocol and ports
+func flowHash(frame []byte) uint32 {
+	var h uint32
+	var proto byte
+	var l4off int
+	switch {
+	case len(frame) >= 20 && frame[0]>>4 == 4:
+		h = fnv32(FNV32_OFFSET, frame[12:20])
+		proto = frame[9]
+		l4off = int(frame[0]&0x0f) * 4
+	case len(frame) >= 40 && frame[0]>>4 == 6:
+		h = fnv32(FNV32_OFFSET, frame[8:40])
+		proto = frame[6]
+		l4off = 40
+	default:
+		return 0
+	}
+	h = fnv32(h, []byte{proto})
+	if (proto == 6 || proto == 17) && len(frame) >= l4off+4 {
+		h = fnv32(h, frame[l4off:l4off+4])
+	}
+	return h
+}
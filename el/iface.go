@@ -23,8 +23,10 @@ package el
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
@@ -32,59 +34,191 @@ import (
 	"strings"
 
 	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 var invalidAddr = errors.New("Invalid device ip address")
 
 var tun_peer net.IP
 
-func newTun(name string) (iface *water.Interface, err error) {
+var invalidDevType = errors.New("Invalid device type")
 
-	iface, err = water.NewTUN(name)
+const (
+	TOPOLOGY_P2P    int = iota // a peer address next to ours to route via
+	TOPOLOGY_SUBNET            // the subnet on link
+)
+
+var invalidTopology = errors.New("Invalid topology")
+
+const (
+	REDIRECT_ROUTES int = iota // 0.0.0.0/1 and 128.0.0.0/1 plus a route to the server
+	REDIRECT_FWMARK            // a table of its own for all traffic not marked as ours
+)
+
+// fwmark of elvpn's sockets and the routing table of the tunnel, unless
+// configured
+const (
+	FWMARK_DEFAULT = 0x454c
+	// the main table is looked at before the tunnel table, every route
+	// in it but the default one wins
+	FWMARK_RULE_PRIO = 32000
+)
+
+var invalidRedirectMode = errors.New("Invalid redirect mode")
+
+func parseRedirectMode(s string) (int, error) {
+	switch s {
+	case "", "routes":
+		return REDIRECT_ROUTES, nil
+	case "fwmark":
+		return REDIRECT_FWMARK, nil
+	default:
+		return 0, invalidRedirectMode
+	}
+}
+
+func parseTopology(s string) (int, error) {
+	switch s {
+	case "", "p2p":
+		return TOPOLOGY_P2P, nil
+	case "subnet":
+		return TOPOLOGY_SUBNET, nil
+	default:
+		return 0, invalidTopology
+	}
+}
+
+// tun unless tap is asked for
+func parseDevType(s string) (tap bool, err error) {
+	switch s {
+	case "", "tun":
+		return false, nil
+	case "tap":
+		return true, nil
+	default:
+		return false, invalidDevType
+	}
+}
+
+// one queue of a tun device, either water's or our offloading one
+type tunDevice interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
+// devices that can write several packets at once
+type batchWriter interface {
+	WriteBatch(pkts [][]byte) error
+}
+
+func newTun(name string) (iface tunDevice, err error) {
+	queues, err := newTunQueues(name, false, 1, false)
 	if err != nil {
 		return nil, err
 	}
-	logger.Info("interface %v created", iface.Name())
+	return queues[0], nil
+}
 
-	sargs := fmt.Sprintf("link set dev %s up mtu %d qlen 100", iface.Name(), MTU)
-	args := strings.Split(sargs, " ")
-	cmd := exec.Command("ip", args...)
-	logger.Info("ip %s", sargs)
-	err = cmd.Run()
-	if err != nil {
+// create a tun or tap device with n queues, more than one queue sets
+// IFF_MULTI_QUEUE and every queue is a fd of its own. With offload
+// the device reads and writes TSO/USO super packets.
+func newTunQueues(name string, tap bool, n int, offload bool) (queues []tunDevice, err error) {
+	if n <= 0 {
+		n = 1
+	}
+	cfg := water.Config{DeviceType: water.TUN}
+	if tap {
+		if offload {
+			return nil, errors.New("tap devices can't offload segmentation")
+		}
+		cfg.DeviceType = water.TAP
+	}
+	cfg.Name = name
+	cfg.MultiQueue = n > 1
+
+	for i := 0; i < n; i++ {
+		var iface tunDevice
+		if offload {
+			iface, err = openVnetTun(cfg.Name, cfg.MultiQueue)
+		} else {
+			iface, err = water.New(cfg)
+		}
+		if err != nil {
+			for _, q := range queues {
+				q.Close()
+			}
+			return nil, err
+		}
+		// the other queues attach to the device the first one created
+		cfg.Name = iface.Name()
+		queues = append(queues, iface)
+	}
+	logger.Info("interface %v created with %d queues", cfg.Name, n)
+	if offload {
+		logger.Info("interface %v offloads segmentation", cfg.Name)
+	}
+
+	if err = rtnl.linkUp(cfg.Name, MTU, 100); err != nil {
 		return nil, err
 	}
 
-	return iface, nil
+	return queues, nil
 }
 
-func setTunIP(iface *water.Interface, ip net.IP, subnet *net.IPNet) (err error) {
+// write frames to the device, in one go if it can
+func writeFrames(iface tunDevice, frames [][]byte) error {
+	if bw, ok := iface.(batchWriter); ok {
+		return bw.WriteBatch(frames)
+	}
+	for _, frame := range frames {
+		if _, err := iface.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setTunIP(iface tunDevice, ip net.IP, subnet *net.IPNet) (err error) {
 	ip = ip.To4()
 	logger.Debug("%v", ip)
-	if ip[3]%2 == 0 {
+	if ip == nil {
 		return invalidAddr
 	}
 
-	peer := net.IP(make([]byte, 4))
-	copy([]byte(peer), []byte(ip))
-	peer[3]++
+	// the other end is the next address for odd ones and the
+	// previous one for even ones, it stays in the same subnet
+	peer := uint32ToIP4(ip4ToUint32(ip) + 1)
+	if ip[3]%2 == 0 {
+		peer = uint32ToIP4(ip4ToUint32(ip) - 1)
+	}
 	tun_peer = peer
 
-	sargs := fmt.Sprintf("addr add dev %s local %s peer %s", iface.Name(), ip, peer)
-	args := strings.Split(sargs, " ")
-	cmd := exec.Command("ip", args...)
-	logger.Info("ip %s", sargs)
-	err = cmd.Run()
+	err = rtnl.addrAdd(iface.Name(), hostRoute(ip), hostRoute(peer))
 	if err != nil {
 		return err
 	}
+	return addRouteVia(subnet, peer, iface.Name())
+}
 
-	sargs = fmt.Sprintf("route add %s via %s dev %s", subnet, peer, iface.Name())
-	args = strings.Split(sargs, " ")
-	cmd = exec.Command("ip", args...)
-	logger.Info("ip %s", sargs)
-	err = cmd.Run()
-	return err
+// the address and its whole subnet on link, no peer to route
+// through, for tap devices and the subnet topology
+func setSubnetIP(iface tunDevice, ip net.IP, subnet *net.IPNet) (err error) {
+	tun_peer = nil
+	return rtnl.addrAdd(iface.Name(), &net.IPNet{IP: ip, Mask: subnet.Mask}, nil)
+}
+
+func setMTU(iface tunDevice, mtu int) error {
+	return rtnl.linkMTU(iface.Name(), mtu)
+}
+
+// attach the device to a linux bridge
+func setBridge(iface tunDevice, bridge string) error {
+	return rtnl.linkMaster(iface.Name(), bridge)
+}
+
+func setTunIP6(iface tunDevice, ip net.IP, subnet *net.IPNet) (err error) {
+	return rtnl.addrAdd(iface.Name(), &net.IPNet{IP: ip, Mask: subnet.Mask}, nil)
 }
 
 // return net gateway (default route) and nic
@@ -143,31 +277,103 @@ func getNetGateway() (gw, dev string, err error) {
 	return "", "", errors.New("No default gateway found")
 }
 
-// add route
-func addRoute(dest, nextHop, iface string) {
+// return ipv6 net gateway (default route) and nic
+func getNetGateway6() (gw, dev string, err error) {
+	file, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	// dest, dest prefix, src, src prefix, next hop, metric,
+	// refcnt, use, flags, device
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) < 10 {
+			continue
+		}
+		if tokens[0] != strings.Repeat("0", 32) || tokens[1] != "00" ||
+			tokens[4] == strings.Repeat("0", 32) || tokens[9] == "lo" {
+			continue
+		}
+		nh, err := hex.DecodeString(tokens[4])
+		if err != nil || len(nh) != net.IPv6len {
+			continue
+		}
+		return net.IP(nh).String(), tokens[9], nil
+	}
+	return "", "", errors.New("No default IPv6 gateway found")
+}
 
-	scmd := fmt.Sprintf("ip -4 r a %s via %s dev %s", dest, nextHop, iface)
-	cmd := exec.Command("bash", "-c", scmd)
-	logger.Info(scmd)
-	err := cmd.Run()
+// a prefix, or a single address as a host route
+func parseDest(dest string) (*net.IPNet, error) {
+	if !strings.Contains(dest, "/") {
+		ip := net.ParseIP(dest)
+		if ip == nil {
+			return nil, invalidAddr
+		}
+		return hostRoute(ip), nil
+	}
+	_, n, err := net.ParseCIDR(dest)
+	return n, err
+}
 
+// route dest via gw on iface, on link if gw is nil
+func addRouteVia(dest *net.IPNet, gw net.IP, iface string) error {
+	link, err := rtnl.link(iface)
 	if err != nil {
-		logger.Warning(err.Error())
+		return err
 	}
+	r := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dest, Gw: gw}
+	if gw == nil {
+		r.Scope = netlink.SCOPE_LINK
+	}
+	return rtnl.routeAdd(r)
+}
 
+// add route, of either family
+func addRoute(dest, nextHop, iface string) error {
+	d, err := parseDest(dest)
+	if err != nil {
+		return err
+	}
+	gw := net.ParseIP(nextHop)
+	if gw == nil {
+		return invalidAddr
+	}
+	return addRouteVia(d, gw, iface)
 }
 
 // delete route
-func delRoute(dest string) {
-	sargs := fmt.Sprintf("-4 route del %s", dest)
-	args := strings.Split(sargs, " ")
-	cmd := exec.Command("ip", args...)
-	logger.Info("ip %s", sargs)
-	err := cmd.Run()
+func delRoute(dest string) error {
+	d, err := parseDest(dest)
+	if err != nil {
+		return err
+	}
+	return rtnl.routeDel(d)
+}
 
+// route a subnet of either family straight to a device
+func addDevRoute(dest, iface string) error {
+	d, err := parseDest(dest)
 	if err != nil {
-		logger.Warning(err.Error())
+		return err
 	}
+	return addRouteVia(d, nil, iface)
+}
+
+// redirect ipv6 default gateway, the tun is point to point
+// so the routes don't need a next hop
+func redirectGateway6(iface string) error {
+	subnets := []string{"::/1", "8000::/1"}
+	logger.Info("Redirecting IPv6 Gateway")
+	for _, subnet := range subnets {
+		if err := addDevRoute(subnet, iface); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // redirect default gateway
@@ -175,12 +381,13 @@ func redirectGateway(iface, gw string) error {
 	subnets := []string{"0.0.0.0/1", "128.0.0.0/1"}
 	logger.Info("Redirecting Gateway")
 	for _, subnet := range subnets {
-		sargs := fmt.Sprintf("-4 route add %s via %s dev %s", subnet, gw, iface)
-		args := strings.Split(sargs, " ")
-		cmd := exec.Command("ip", args...)
-		logger.Info("ip %s", sargs)
-		err := cmd.Run()
-
+		var err error
+		if gw == "" {
+			// on link
+			err = addDevRoute(subnet, iface)
+		} else {
+			err = addRoute(subnet, gw, iface)
+		}
 		if err != nil {
 			return err
 		}
@@ -188,6 +395,51 @@ func redirectGateway(iface, gw string) error {
 	return nil
 }
 
+// send everything but the packets marked with mark through the tunnel,
+// the default route goes to a table of its own which all unmarked
+// traffic looks up, like wg-quick does. The server needs no route of
+// its own then and a change of the underlying network doesn't matter.
+func redirectGatewayMark(iface string, gw net.IP, v6 bool, mark, table int) error {
+	family, dest := FAMILY_V4, &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	if v6 {
+		family, dest = FAMILY_V6, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+		gw = nil
+	} else if err := os.WriteFile("/proc/sys/net/ipv4/conf/all/src_valid_mark", []byte("1"), 0644); err != nil {
+		// rp_filter would drop the replies to marked packets otherwise
+		logger.Warning("src_valid_mark: %v", err)
+	}
+	logger.Info("Redirecting Gateway through table %d, fwmark 0x%x", table, mark)
+
+	link, err := rtnl.link(iface)
+	if err != nil {
+		return err
+	}
+	r := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dest, Gw: gw, Table: table}
+	if gw == nil {
+		r.Scope = netlink.SCOPE_LINK
+	}
+	if err = rtnl.routeAdd(r); err != nil {
+		return err
+	}
+
+	suppress := netlink.NewRule()
+	suppress.Family = family
+	suppress.Priority = FWMARK_RULE_PRIO
+	suppress.Table = unix.RT_TABLE_MAIN
+	suppress.SuppressPrefixlen = 0
+	if err = rtnl.ruleAdd(suppress); err != nil {
+		return err
+	}
+
+	tunnel := netlink.NewRule()
+	tunnel.Family = family
+	tunnel.Priority = FWMARK_RULE_PRIO + 1
+	tunnel.Invert = true
+	tunnel.Mark = uint32(mark)
+	tunnel.Table = table
+	return rtnl.ruleAdd(tunnel)
+}
+
 // redirect ports to one
 func redirectPort(from, to string) error {
 	//iptables -t nat -A PREROUTING -p udp -m udp --dport 40000:41000 -j REDIRECT --to-ports 1234
@@ -229,44 +481,3 @@ func unredirectPort(from, to string) error {
 	}
 	return nil
 }
-
-func fixMSS(iface string, is_server bool) error {
-	mss := MTU - 40
-	logger.Info("Fix MSS with iptables to %d", mss)
-	io := "o"
-	if is_server {
-		io = "i"
-	}
-
-	sargs := fmt.Sprintf("-I FORWARD -%s %s -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss %d", io, iface, mss)
-	args := strings.Split(sargs, " ")
-	cmd := exec.Command("iptables", args...)
-	logger.Info("iptables %s", sargs)
-	err := cmd.Run()
-
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func clearMSS(iface string, is_server bool) error {
-	mss := MTU - 40
-	logger.Info("Clean MSS fix")
-	io := "o"
-
-	if is_server {
-		io = "i"
-	}
-	sargs := fmt.Sprintf("-D FORWARD -%s %s -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss %d", io, iface, mss)
-
-	args := strings.Split(sargs, " ")
-	cmd := exec.Command("iptables", args...)
-	err := cmd.Run()
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
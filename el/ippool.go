@@ -1,49 +1,419 @@
 package el
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
-	"sync/atomic"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// elIPPool hands out the addresses of its ranges, the whole subnet
+// unless configured otherwise. Reserved addresses only ever go to
+// their client, and a client gets its last address back as long as
+// its lease hasn't run out, leases survive restarts in a state file.
 type elIPPool struct {
 	subnet *net.IPNet
-	pool   [127]int32
+	// assignable addresses, inclusive
+	ranges [][2]uint32
+	used   map[uint32]bool
+	// static addresses by client name, never handed out to others
+	reserved    map[string]uint32
+	reservedIPs map[uint32]bool
+	// the address a client had last, by client key
+	leases    map[string]*elLease
+	leaseTime time.Duration
+	leaseFile string
+	// leases changed since they were last written, and the
+	// writer's wake up call
+	dirty bool
+	save  chan struct{}
+	// where the search for a free address goes on
+	cursor uint32
+	_lock  sync.Mutex
 }
 
 var poolFull = errors.New("IP Pool Full")
 
-func (p *elIPPool) next() (*net.IPNet, error) {
+// how long a gone client's address is kept for it
+const POOL_LEASE_TIME = 24 * time.Hour
+
+// changes to the leases within this long are written at once
+const LEASE_SAVE_DELAY = time.Second
+
+func ip4ToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP4(i uint32) net.IP {
+	ip := net.IP(make([]byte, net.IPv4len))
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
+
+// a pool of subnet's addresses but self's, ranges are "first-last"
+// pairs, reservations map client names to addresses
+func newElIPPool(subnet *net.IPNet, self net.IP, ranges []string, reservations map[string]string) (*elIPPool, error) {
+	p := new(elIPPool)
+	p.subnet = subnet
+	p.used = make(map[uint32]bool)
+	p.reserved = make(map[string]uint32)
+	p.reservedIPs = make(map[uint32]bool)
+	p.leases = make(map[string]*elLease)
+	p.leaseTime = POOL_LEASE_TIME
+
+	ones, bits := subnet.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("subnet %s is too small for a pool", subnet)
+	}
+	network := ip4ToUint32(subnet.IP)
+	broadcast := network | (1<<uint(32-ones) - 1)
+
+	for _, r := range ranges {
+		first, last, found := strings.Cut(r, "-")
+		firstIP, lastIP := net.ParseIP(strings.TrimSpace(first)), net.ParseIP(strings.TrimSpace(last))
+		if !found || firstIP.To4() == nil || lastIP.To4() == nil ||
+			!subnet.Contains(firstIP) || !subnet.Contains(lastIP) {
+			return nil, fmt.Errorf("invalid pool range %s", r)
+		}
+		p.ranges = append(p.ranges, [2]uint32{ip4ToUint32(firstIP), ip4ToUint32(lastIP)})
+	}
+	if len(p.ranges) == 0 {
+		p.ranges = [][2]uint32{{network + 1, broadcast - 1}}
+	}
+
+	// the server's own address is taken for good
+	p.reservedIPs[ip4ToUint32(self)] = true
+	for name, addr := range reservations {
+		ip := net.ParseIP(addr)
+		if ip.To4() == nil || !subnet.Contains(ip) {
+			return nil, fmt.Errorf("invalid reservation %s for %s", addr, name)
+		}
+		i := ip4ToUint32(ip)
+		if p.reservedIPs[i] {
+			return nil, fmt.Errorf("address %s reserved twice", addr)
+		}
+		p.reserved[name] = i
+		p.reservedIPs[i] = true
+	}
+	p.cursor = p.ranges[0][0]
+	return p, nil
+}
+
+func (p *elIPPool) inRanges(i uint32) bool {
+	for _, r := range p.ranges {
+		if i >= r[0] && i <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// an address for the client known as key, its name if it has one
+func (p *elIPPool) next(key string) (*net.IPNet, error) {
+	defer p._lock.Unlock()
+	p._lock.Lock()
+
+	p.expireLeases()
+
 	found := false
-	var i int
-	for i = 3; i < 255; i += 2 {
-		if atomic.CompareAndSwapInt32(&p.pool[i], 0, 1) {
-			found = true
-			break
+	var i uint32
+	if r, ok := p.reserved[key]; ok {
+		// a reconnecting client may still hold it in a session
+		// about to time out, the address is its own anyway
+		i, found = r, true
+	} else if l, ok := p.leases[key]; ok && !p.used[l.ip] && !p.reservedIPs[l.ip] && p.inRanges(l.ip) {
+		i, found = l.ip, true
+	} else {
+		// addresses leased to others are the last resort
+		if i, found = p.nextFree(p.leasedIPs()); !found {
+			i, found = p.nextFree(nil)
 		}
 	}
 	if !found {
 		return nil, poolFull
 	}
 
-	ipnet := &net.IPNet{
-		make([]byte, 4),
-		make([]byte, 4),
+	p.used[i] = true
+	if key != "" {
+		for k, l := range p.leases {
+			if l.ip == i {
+				delete(p.leases, k)
+			}
+		}
+		p.leases[key] = &elLease{i, time.Now().Add(p.leaseTime)}
+		p.saveLeases()
+	}
+	return &net.IPNet{IP: uint32ToIP4(i), Mask: p.subnet.Mask}, nil
+}
+
+// first free address after the cursor, round robin over the ranges
+// so that a just released address isn't handed out at once
+func (p *elIPPool) nextFree(skip map[uint32]bool) (uint32, bool) {
+	var size uint64
+	for _, r := range p.ranges {
+		size += uint64(r[1]-r[0]) + 1
+	}
+
+	ri := 0
+	for k, r := range p.ranges {
+		if p.cursor >= r[0] && p.cursor <= r[1] {
+			ri = k
+			break
+		}
 	}
-	copy([]byte(ipnet.IP), []byte(p.subnet.IP))
-	copy([]byte(ipnet.Mask), []byte(p.subnet.Mask))
-	ipnet.IP[3] = byte(i)
-	return ipnet, nil
+	i := p.cursor
+	for n := uint64(0); n < size; n++ {
+		if !p.used[i] && !p.reservedIPs[i] && !skip[i] {
+			p.cursor = i + 1
+			if p.cursor > p.ranges[ri][1] || p.cursor == 0 {
+				p.cursor = p.ranges[(ri+1)%len(p.ranges)][0]
+			}
+			return i, true
+		}
+		if i == p.ranges[ri][1] {
+			ri = (ri + 1) % len(p.ranges)
+			i = p.ranges[ri][0]
+		} else {
+			i++
+		}
+	}
+	return 0, false
 }
 
 func (p *elIPPool) relase(ip net.IP) {
-	defer func() {
-		if err := recover(); err != nil {
-			logger.Error("%v", err)
+	if ip.To4() == nil {
+		return
+	}
+	defer p._lock.Unlock()
+	p._lock.Lock()
+
+	logger.Debug("releasing ip: %v", ip)
+	i := ip4ToUint32(ip)
+	delete(p.used, i)
+	// the lease runs from when the client is gone
+	for _, l := range p.leases {
+		if l.ip == i {
+			l.expires = time.Now().Add(p.leaseTime)
+		}
+	}
+	p.saveLeases()
+}
+
+type elLease struct {
+	ip      uint32
+	expires time.Time
+}
+
+// a lease as kept in the state file
+type elLeaseRecord struct {
+	Client  string    `json:"client"`
+	Addr    string    `json:"addr"`
+	Expires time.Time `json:"expires"`
+}
+
+// forget the leases of clients gone for longer than the lease time
+func (p *elIPPool) expireLeases() {
+	now := time.Now()
+	for k, l := range p.leases {
+		if !p.used[l.ip] && now.After(l.expires) {
+			delete(p.leases, k)
+		}
+	}
+}
+
+func (p *elIPPool) leasedIPs() map[uint32]bool {
+	ips := make(map[uint32]bool, len(p.leases))
+	for _, l := range p.leases {
+		ips[l.ip] = true
+	}
+	return ips
+}
+
+func (p *elIPPool) leaseRecords() []elLeaseRecord {
+	records := make([]elLeaseRecord, 0, len(p.leases))
+	for k, l := range p.leases {
+		records = append(records, elLeaseRecord{k, uint32ToIP4(l.ip).String(), l.expires})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Client < records[j].Client
+	})
+	return records
+}
+
+// restore the leases of the state file, a missing file is no error
+func (p *elIPPool) loadLeases(filename string, leaseTime time.Duration) error {
+	defer p._lock.Unlock()
+	p._lock.Lock()
+
+	p.leaseFile = filename
+	p.save = make(chan struct{}, 1)
+	go p.leaseWriter()
+	if leaseTime > 0 {
+		p.leaseTime = leaseTime
+	}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []elLeaseRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		ip := net.ParseIP(r.Addr)
+		if ip.To4() == nil || !p.subnet.Contains(ip) {
+			logger.Warning("dropping lease of %s to %s", r.Client, r.Addr)
+			continue
+		}
+		p.leases[r.Client] = &elLease{ip4ToUint32(ip), r.Expires}
+	}
+	p.expireLeases()
+	p.logLeases()
+	return nil
+}
+
+// log the lease table, the lock must be held
+func (p *elIPPool) logLeases() {
+	for _, r := range p.leaseRecords() {
+		if p.used[ip4ToUint32(net.ParseIP(r.Addr))] {
+			logger.Info("lease %s to %s, in use", r.Addr, r.Client)
+		} else {
+			logger.Info("lease %s to %s until %s", r.Addr, r.Client, r.Expires.Format(time.RFC3339))
+		}
+	}
+}
+
+func (p *elIPPool) dumpLeases() {
+	defer p._lock.Unlock()
+	p._lock.Lock()
+
+	logger.Info("%d leases, %d addresses in use", len(p.leases), len(p.used))
+	p.logLeases()
+}
+
+// have the leases written, soon and off the handshake path
+func (p *elIPPool) saveLeases() {
+	if p.leaseFile == "" {
+		return
+	}
+	p.dirty = true
+	select {
+	case p.save <- struct{}{}:
+	default:
+	}
+}
+
+func (p *elIPPool) leaseWriter() {
+	for range p.save {
+		time.Sleep(LEASE_SAVE_DELAY)
+		p.flushLeases()
+	}
+}
+
+// write the leases to the state file if they changed, through a
+// temporary one so that a crash never leaves half a file behind
+func (p *elIPPool) flushLeases() {
+	p._lock.Lock()
+	if !p.dirty {
+		p._lock.Unlock()
+		return
+	}
+	p.dirty = false
+	records := p.leaseRecords()
+	filename := p.leaseFile
+	p._lock.Unlock()
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		logger.Error("leases: %v", err)
+		return
+	}
+	tmp := filename + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		logger.Error("saving leases: %v", err)
+	}
+}
+
+// IPv6 pool, addresses are handed out sequentially from the
+// bottom of the subnet, the server itself keeps its own address
+type elIPPool6 struct {
+	subnet *net.IPNet
+	self   net.IP
+	used   map[uint64]bool
+	last   uint64
+	_lock  sync.Mutex
+}
+
+// host ids are limited to the low 64 bits, more than enough
+const IPPOOL6_MAX_HOSTS = 0xffff
+
+func newElIPPool6(subnet *net.IPNet, self net.IP) *elIPPool6 {
+	p := new(elIPPool6)
+	p.subnet = subnet
+	p.self = self.To16()
+	p.used = make(map[uint64]bool)
+	p.last = 1
+	return p
+}
+
+func (p *elIPPool6) next() (*net.IPNet, error) {
+	defer p._lock.Unlock()
+	p._lock.Lock()
+
+	ones, bits := p.subnet.Mask.Size()
+	hosts := uint64(IPPOOL6_MAX_HOSTS)
+	if bits-ones < 16 {
+		hosts = (uint64(1) << uint(bits-ones)) - 1
+	}
+
+	for n := uint64(0); n < hosts; n++ {
+		i := (p.last+n)%hosts + 1
+		if p.used[i] {
+			continue
+		}
+		ip := ip6Host(p.subnet.IP, i)
+		if ip.Equal(p.self) {
+			continue
 		}
-	}()
+		p.used[i] = true
+		p.last = i
+		return &net.IPNet{IP: ip, Mask: p.subnet.Mask}, nil
+	}
+	return nil, poolFull
+}
+
+func (p *elIPPool6) relase(ip net.IP) {
+	defer p._lock.Unlock()
+	p._lock.Lock()
 
 	logger.Debug("releasing ip: %v", ip)
-	i := ip[3]
-	p.pool[i] = 0
+	ip = ip.To16()
+	i := uint64(0)
+	for _, a := range ip[8:] {
+		i = (i << 8) + uint64(a)
+	}
+	delete(p.used, i)
+}
+
+// the address of host i in a subnet
+func ip6Host(prefix net.IP, i uint64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.To16())
+	for k := 15; k >= 8; k-- {
+		ip[k] |= byte(i)
+		i >>= 8
+	}
+	return ip
 }
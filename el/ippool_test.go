@@ -0,0 +1,158 @@
+package el
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_IPPool_Ranges_Reservations(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/16")
+	p, err := newElIPPool(subnet, net.ParseIP("10.1.0.1"),
+		[]string{"10.1.0.1-10.1.0.3", "10.1.5.254-10.1.6.0"},
+		map[string]string{"branch1": "10.1.0.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server's and the reserved address are skipped, ranges
+	// may cross the third byte
+	want := []string{"10.1.0.2", "10.1.5.254", "10.1.5.255", "10.1.6.0"}
+	for i, w := range want {
+		ipnet, err := p.next(string(rune('a' + i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ipnet.IP.String() != w {
+			t.Errorf("got %s, want %s", ipnet.IP, w)
+		}
+	}
+	if _, err := p.next("e"); err != poolFull {
+		t.Errorf("expected a full pool, got %v", err)
+	}
+
+	ipnet, err := p.next("branch1")
+	if err != nil || ipnet.IP.String() != "10.1.0.3" {
+		t.Errorf("reservation: got %v, %v", ipnet, err)
+	}
+
+	// a client gets its address back once it's free again
+	p.relase(net.ParseIP("10.1.5.255"))
+	p.relase(net.ParseIP("10.1.0.2"))
+	ipnet, err = p.next("c")
+	if err != nil || ipnet.IP.String() != "10.1.5.255" {
+		t.Errorf("reconnect: got %v, %v", ipnet, err)
+	}
+}
+
+func Test_IPPool_WholeSubnet(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.1.0/24")
+	p, err := newElIPPool(subnet, net.ParseIP("10.1.1.1"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 253; i++ {
+		if _, err := p.next(""); err != nil {
+			t.Fatalf("address %d: %v", i, err)
+		}
+	}
+	if _, err := p.next(""); err != poolFull {
+		t.Errorf("expected a full pool, got %v", err)
+	}
+
+	if _, err := newElIPPool(subnet, net.ParseIP("10.1.1.1"), []string{"10.1.2.1-10.1.2.9"}, nil); err == nil {
+		t.Error("range outside the subnet accepted")
+	}
+}
+
+func Test_IPPool_Leases(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.1.0/24")
+	file := t.TempDir() + "/leases.json"
+
+	p, _ := newElIPPool(subnet, net.ParseIP("10.1.1.1"), nil, nil)
+	if err := p.loadLeases(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := p.next("a")
+	b, _ := p.next("b")
+	p.relase(a.IP)
+	p.flushLeases()
+
+	// after a restart both keep their address, a newcomer
+	// doesn't get the one leased to a
+	p, _ = newElIPPool(subnet, net.ParseIP("10.1.1.1"), nil, nil)
+	if err := p.loadLeases(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := p.next("c")
+	if c.IP.Equal(a.IP) || c.IP.Equal(b.IP) {
+		t.Errorf("newcomer got a leased address %s", c.IP)
+	}
+	if b2, _ := p.next("b"); !b2.IP.Equal(b.IP) {
+		t.Errorf("b: got %s, want %s", b2.IP, b.IP)
+	}
+	if a2, _ := p.next("a"); !a2.IP.Equal(a.IP) {
+		t.Errorf("a: got %s, want %s", a2.IP, a.IP)
+	}
+
+	// expired leases are forgotten
+	p.relase(a.IP)
+	p.leases["a"].expires = time.Now().Add(-time.Second)
+	p.saveLeases()
+	p.flushLeases()
+	p, _ = newElIPPool(subnet, net.ParseIP("10.1.1.1"), nil, nil)
+	p.loadLeases(file, 0)
+	if _, found := p.leases["a"]; found {
+		t.Error("expired lease restored")
+	}
+}
+
+// a client that retries its handshake must not keep the
+// addresses and routes of the first one
+func Test_IPPool_HandshakeRetry(t *testing.T) {
+	var err error
+	if cipher, err = newElCipher([]byte("retry")); err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.1.1.0/24")
+	_, subnet6, _ := net.ParseCIDR("fd00:1::/64")
+
+	srv := new(ElServer)
+	srv.sessionTable = make(map[uint64]*ElPeer)
+	srv.routes = newElRouteTable()
+	srv.push = newElOptions()
+	srv.toNet = []*elQueue{newElQueue("toNet", 16, QUEUE_DROP_TAIL)}
+	if srv.ippool, err = newElIPPool(subnet, net.ParseIP("10.1.1.1"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	srv.ippool6 = newElIPPool6(subnet6, net.ParseIP("fd00:1::1"))
+
+	u := &udpPacket{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40100}}
+	hsh := []byte{0, 0, 0, 7, 'a'}
+	srv.handleHandshake(u, &ElPacket{payload: hsh})
+	hpeer, ok := srv.getPeer(7 << 32)
+	if !ok {
+		t.Fatal("no peer after the handshake")
+	}
+	ip, ip6 := hpeer.ip, hpeer.ip6
+
+	srv.handleHandshake(u, &ElPacket{payload: hsh})
+	defer hpeer.stop()
+
+	if !hpeer.ip.Equal(ip) {
+		t.Errorf("retry got %s instead of %s", hpeer.ip, ip)
+	}
+	if n := len(srv.ippool6.used); n != 1 {
+		t.Errorf("%d IPv6 addresses in use after the retry", n)
+	}
+	if !hpeer.ip6.Equal(ip6) {
+		if p, found := srv.routes.lookup(ip6); found {
+			t.Errorf("%s still routed to client %d", ip6, p.id>>32)
+		}
+	}
+	for _, a := range []net.IP{hpeer.ip, hpeer.ip6} {
+		if p, found := srv.routes.lookup(a); !found || p != hpeer {
+			t.Errorf("%s isn't routed to the client", a)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// kill switch, nothing leaves but through the tunnel
+
+package el
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+const KILL_SWITCH_TABLE = "inet elvpn_killswitch"
+
+// what the kill switch lets through besides the tunnel and loopback
+type elKillSwitch struct {
+	iface            string
+	servers          []net.IP
+	hopStart, hopEnd int
+	// mark of elvpn's own sockets, the only ones to reach the server
+	mark  int
+	allow []*net.IPNet
+	// bypass-routes destinations, routed around the tunnel on purpose
+	bypass []*net.IPNet
+	// where the server's name is looked up, until it is
+	resolvers []net.IP
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
+
+// the ruleset of the kill switch table, replacing the table in one
+// transaction so there is no moment without it. Besides the tunnel,
+// loopback and the allowlist only elvpn's udp to the server's hop ports,
+// the bypass routes, dhcp and ipv6 neighbor discovery get through.
+func (k *elKillSwitch) rules() string {
+	ports := fmt.Sprint(k.hopStart)
+	if k.hopEnd > k.hopStart {
+		ports = fmt.Sprintf("%d-%d", k.hopStart, k.hopEnd)
+	}
+	mark := ""
+	if k.mark != 0 {
+		mark = fmt.Sprintf("meta mark 0x%x ", k.mark)
+	}
+	bypass4, bypass6 := splitFamilies(k.bypass)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "table %s\ndelete table %s\n", KILL_SWITCH_TABLE, KILL_SWITCH_TABLE)
+	fmt.Fprintf(buf, "table %s {\n", KILL_SWITCH_TABLE)
+	writeSet(buf, "bypass4", "ipv4_addr", bypass4)
+	writeSet(buf, "bypass6", "ipv6_addr", bypass6)
+
+	buf.WriteString("\tchain output {\n")
+	buf.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	buf.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(buf, "\t\toifname %q accept\n", k.iface)
+	for _, ip := range k.servers {
+		fmt.Fprintf(buf, "\t\t%s%s daddr %s udp dport %s accept\n", mark, ipFamily(ip), ip, ports)
+	}
+	for _, ip := range k.resolvers {
+		fmt.Fprintf(buf, "\t\t%s daddr %s meta l4proto { tcp, udp } th dport 53 accept\n", ipFamily(ip), ip)
+	}
+	for _, n := range k.allow {
+		fmt.Fprintf(buf, "\t\t%s daddr %s accept\n", ipFamily(n.IP), n)
+	}
+	if len(bypass4) > 0 {
+		buf.WriteString("\t\tip daddr @bypass4 accept\n")
+	}
+	if len(bypass6) > 0 {
+		buf.WriteString("\t\tip6 daddr @bypass6 accept\n")
+	}
+	buf.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	buf.WriteString("\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	buf.WriteString("\t}\n")
+
+	buf.WriteString("\tchain input {\n")
+	buf.WriteString("\t\ttype filter hook input priority 0; policy drop;\n")
+	buf.WriteString("\t\tiifname \"lo\" accept\n")
+	fmt.Fprintf(buf, "\t\tiifname %q accept\n", k.iface)
+	buf.WriteString("\t\tct state established,related accept\n")
+	for _, n := range k.allow {
+		fmt.Fprintf(buf, "\t\t%s saddr %s accept\n", ipFamily(n.IP), n)
+	}
+	buf.WriteString("\t\tudp sport 67 udp dport 68 accept\n")
+	buf.WriteString("\t\ticmpv6 type { nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	buf.WriteString("\t}\n")
+
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// a named set of prefixes, none if there are no elements
+func writeSet(buf *bytes.Buffer, name, typ string, nets []*net.IPNet) {
+	if len(nets) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "\tset %s {\n\t\ttype %s; flags interval;\n\t\telements = {", name, typ)
+	for i, n := range nets {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(buf, " %s", n)
+	}
+	buf.WriteString(" }\n\t}\n")
+}
+
+// the kill-switch-allow prefixes, single addresses are host routes
+func parseKillSwitchAllow(allow []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(allow))
+	for _, s := range allow {
+		n, err := parseDest(s)
+		if err != nil {
+			return nil, fmt.Errorf("kill-switch-allow %s: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (k *elKillSwitch) enable() error {
+	if len(k.servers) == 0 {
+		logger.Info("kill switch on, the server is looked up through %v", k.resolvers)
+	} else {
+		logger.Info("kill switch on, only %s and the server get through", k.iface)
+	}
+	return runNft(k.rules())
+}
+
+// DisableKillSwitch lifts the kill switch, the one a client that crashed
+// or was finished by the server left in place too
+func DisableKillSwitch() error {
+	logger.Info("kill switch off")
+	return runNft(fmt.Sprintf("table %s\ndelete table %s\n", KILL_SWITCH_TABLE, KILL_SWITCH_TABLE))
+}
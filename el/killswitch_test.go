@@ -0,0 +1,56 @@
+package el
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_KillSwitch_Rules(t *testing.T) {
+	servers := []net.IP{net.ParseIP("198.51.100.1"), net.ParseIP("2001:db8::1")}
+	k := &elKillSwitch{
+		iface:    "tun0",
+		servers:  servers,
+		hopStart: 1194,
+		hopEnd:   1200,
+		mark:     FWMARK_DEFAULT,
+		allow:    []*net.IPNet{mustCIDR(t, "192.168.1.0/24")},
+		bypass:   []*net.IPNet{mustCIDR(t, "1.0.1.0/24"), mustCIDR(t, "1.0.2.0/23")},
+	}
+	rules := k.rules()
+
+	for _, want := range []string{
+		"delete table inet elvpn_killswitch\n",
+		"policy drop;",
+		"oifname \"tun0\" accept",
+		"meta mark 0x454c ip daddr 198.51.100.1 udp dport 1194-1200 accept",
+		"meta mark 0x454c ip6 daddr 2001:db8::1 udp dport 1194-1200 accept",
+		"elements = { 1.0.1.0/24, 1.0.2.0/23 }",
+		"ip daddr @bypass4 accept",
+		"ip daddr 192.168.1.0/24 accept",
+		"ip saddr 192.168.1.0/24 accept",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("missing %q in\n%s", want, rules)
+		}
+	}
+	// the table is flushed and filled in the same transaction
+	if !strings.HasPrefix(rules, "table inet elvpn_killswitch\n") {
+		t.Errorf("rules don't replace the table:\n%s", rules)
+	}
+
+	if strings.Contains(rules, "bypass6") {
+		t.Errorf("empty set in\n%s", rules)
+	}
+
+	// a kill switch left up lets the server be looked up
+	k = &elKillSwitch{iface: "tun0", hopStart: 1194, hopEnd: 1194, resolvers: []net.IP{net.ParseIP("192.0.2.53")}}
+	rules = k.rules()
+	if !strings.Contains(rules, "ip daddr 192.0.2.53 meta l4proto { tcp, udp } th dport 53 accept") {
+		t.Errorf("resolver not let through:\n%s", rules)
+	}
+	k.servers, k.resolvers = servers[:1], nil
+	if rules = k.rules(); !strings.Contains(rules, "\tip daddr 198.51.100.1 udp dport 1194 accept") {
+		t.Errorf("single port:\n%s", rules)
+	}
+}
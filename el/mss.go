@@ -0,0 +1,199 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// tcp mss clamping of the packets through the tun device
+
+package el
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+const (
+	MSS_CLAMP_PROCESS  int = iota // rewritten by elvpn on the way through the device
+	MSS_CLAMP_FIREWALL            // a TCPMSS rule of the elvpn firewall
+)
+
+const (
+	// the udp and ip (v6 at worst) headers of a tunnelled packet
+	UDP_IP_OVERHEAD = 8 + 40
+
+	TCP_OPT_END = 0
+	TCP_OPT_NOP = 1
+	TCP_OPT_MSS = 2
+)
+
+var invalidMSSClamp = errors.New("Invalid mss clamp")
+
+func parseMSSClamp(s string) (int, error) {
+	switch s {
+	case "", "process":
+		return MSS_CLAMP_PROCESS, nil
+	case "firewall":
+		return MSS_CLAMP_FIREWALL, nil
+	default:
+		return 0, invalidMSSClamp
+	}
+}
+
+// what Pack adds to a packet of n bytes that don't compress, the hop
+// header, the iv, padding and snappy's framing, whatever the key
+func packOverhead(n int) int {
+	c, err := newElCipher(nil)
+	if err != nil {
+		return 0
+	}
+	buf := getBufferSize(HOP_HDR_LEN + n)
+	defer putBuffer(buf)
+	rand.Read(buf)
+	enc := c.encrypt(buf)
+	defer putBuffer(enc)
+	return len(enc) - n
+}
+
+// tunnelMTU and the MTU it was worked out for, in the high half, so
+// that packing a packet to learn the overhead happens once per MTU
+var tunnelMTUCache uint64
+
+// the largest packet that fits in a datagram of MTU bytes once elvpn
+// packed it
+func tunnelMTU() int {
+	mtu := MTU
+	if c := atomic.LoadUint64(&tunnelMTUCache); c != 0 && int(c>>32) == mtu {
+		return int(int32(uint32(c)))
+	}
+	tmtu := mtu - packOverhead(mtu) - UDP_IP_OVERHEAD
+	atomic.StoreUint64(&tunnelMTUCache, uint64(mtu)<<32|uint64(uint32(int32(tmtu))))
+	return tmtu
+}
+
+// the mss of tcp over ipv4 or ipv6 packets that fit tunnelMTU
+func mssLimit(v6 bool) int {
+	if v6 {
+		return tunnelMTU() - 60
+	}
+	return tunnelMTU() - 40
+}
+
+// lower the mss option of a tcp syn (or syn-ack) in ip packet pkt to
+// what fits the tunnel, updating the tcp checksum, returns true if it
+// did. anything else is left alone.
+func clampMSS(pkt []byte) bool {
+	var l4off int
+	var v6 bool
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		// not the first fragment, or no tcp header
+		if pkt[9] != IPPROTO_TCP || binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return false
+		}
+		l4off = ihl
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		l4off = ipv6TCPOffset(pkt)
+		v6 = true
+	default:
+		return false
+	}
+	if l4off <= 0 || l4off+20 > len(pkt) {
+		return false
+	}
+	tcp := pkt[l4off:]
+	if tcp[13]&(TCP_FLG_SYN|TCP_FLG_RST) != TCP_FLG_SYN {
+		return false
+	}
+	doff := int(tcp[12]>>4) * 4
+	if doff < 20 || doff > len(tcp) {
+		return false
+	}
+
+	limit := uint16(mssLimit(v6))
+	opts := tcp[20:doff]
+	for i := 0; i < len(opts); {
+		kind := opts[i]
+		if kind == TCP_OPT_END {
+			break
+		}
+		if kind == TCP_OPT_NOP {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return false
+		}
+		if kind == TCP_OPT_MSS && opts[i+1] == 4 {
+			field := opts[i+2 : i+4]
+			mss := binary.BigEndian.Uint16(field)
+			if mss <= limit {
+				return false
+			}
+			binary.BigEndian.PutUint16(field, limit)
+			csum := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], csumReplace(csum, mss, limit))
+			return true
+		}
+		i += int(opts[i+1])
+	}
+	return false
+}
+
+// offset of the tcp header of an ipv6 packet behind the extension
+// headers that may come first, 0 if it's not tcp or a fragment
+func ipv6TCPOffset(pkt []byte) int {
+	next, off := pkt[6], 40
+	for {
+		switch next {
+		case IPPROTO_TCP:
+			return off
+		// hop-by-hop, routing and destination options
+		case 0, 43, 60:
+			if off+8 > len(pkt) {
+				return 0
+			}
+			next, off = pkt[off], off+(int(pkt[off+1])+1)*8
+		default:
+			return 0
+		}
+	}
+}
+
+// the checksum csum with one 16 bit word changed from from to to,
+// without summing the packet again (RFC 1624)
+func csumReplace(csum, from, to uint16) uint16 {
+	sum := uint32(^csum) + uint32(^from) + uint32(to)
+	return ^csumFold(sum)
+}
+
+// the ip packet of a frame read from or written to the device,
+// nil for anything else a tap device carries
+func ipFrame(frame []byte, tap bool) []byte {
+	if !tap {
+		return frame
+	}
+	if len(frame) < ETH_HDR_LEN {
+		return nil
+	}
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case 0x0800, 0x86dd:
+		return frame[ETH_HDR_LEN:]
+	}
+	return nil
+}
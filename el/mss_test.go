@@ -0,0 +1,83 @@
+package el
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// a tcp syn with an mss option over ipv4, or ipv6 from the same ports
+func testSynPacket(v6 bool, mss uint16) []byte {
+	pkt := testTCPPacket(1, 0, TCP_FLG_SYN)
+	copy(pkt[40:52], []byte{TCP_OPT_MSS, 4, 0, 0, 1, 1, 1, 1, 1, 1, 1, TCP_OPT_END})
+	binary.BigEndian.PutUint16(pkt[42:44], mss)
+	if v6 {
+		tcp := pkt[20:]
+		pkt = make([]byte, 40+len(tcp))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(tcp)))
+		pkt[6] = IPPROTO_TCP
+		pkt[7] = 64
+		pkt[8], pkt[23] = 0xfd, 3
+		pkt[24], pkt[39] = 0xfd, 1
+		copy(pkt[40:], tcp)
+		l4Checksum(pkt, IPPROTO_TCP, 40)
+		return pkt
+	}
+	l4Checksum(pkt, IPPROTO_TCP, 20)
+	return pkt
+}
+
+func Test_MSS_Clamp(t *testing.T) {
+	defer func(mtu int) { MTU = mtu }(MTU)
+	MTU = 1400
+	// follows the mtu, less what packing adds
+	if over := packOverhead(MTU); over <= HOP_HDR_LEN+cipherBlockSize || over > HOP_HDR_LEN+2*cipherBlockSize+8 {
+		t.Errorf("pack overhead %d", over)
+	}
+	mtu := tunnelMTU()
+	MTU = 1300
+	if d := mtu - tunnelMTU(); d < 100-cipherBlockSize || d > 100+cipherBlockSize {
+		t.Errorf("tunnel mtu %d at mtu 1300, %d at 1400", tunnelMTU(), mtu)
+	}
+
+	for _, v6 := range []bool{false, true} {
+		l4off, limit := 20, uint16(tunnelMTU()-40)
+		if v6 {
+			l4off, limit = 40, uint16(tunnelMTU()-60)
+		}
+
+		pkt := testSynPacket(v6, 1460)
+		if !clampMSS(pkt) {
+			t.Fatalf("v6 %v: syn not clamped", v6)
+		}
+		if mss := binary.BigEndian.Uint16(pkt[l4off+22:]); mss != limit {
+			t.Errorf("v6 %v: mss %d, want %d", v6, mss, limit)
+		}
+		sum := pseudoSum(pkt, IPPROTO_TCP, len(pkt)-l4off)
+		if csumFold(csumAdd(sum, pkt[l4off:])) != 0xffff {
+			t.Errorf("v6 %v: bad tcp checksum", v6)
+		}
+		if !v6 {
+			validChecksums(t, pkt)
+		}
+
+		// small enough already, or no syn
+		if clampMSS(testSynPacket(v6, 1000)) {
+			t.Errorf("v6 %v: lower mss raised", v6)
+		}
+		pkt = testSynPacket(v6, 1460)
+		pkt[l4off+13] = TCP_FLG_ACK
+		if clampMSS(pkt) {
+			t.Errorf("v6 %v: ack clamped", v6)
+		}
+	}
+}
+
+func BenchmarkClampMSS(b *testing.B) {
+	syn := testSynPacket(false, 1460)
+	pkt := make([]byte, len(syn))
+	for i := 0; i < b.N; i++ {
+		copy(pkt, syn)
+		clampMSS(pkt)
+	}
+}
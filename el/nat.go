@@ -0,0 +1,158 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// masquerading the tunnel subnets out of the server
+
+package el
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+type elNat struct {
+	egress  string
+	subnets []*net.IPNet
+	// sysctls turned on, with the values they had
+	sysctls map[string]string
+}
+
+// nil if the nat option isn't set
+func newElNat(cfg ElServerConfig) (*elNat, error) {
+	if cfg.Nat == "" {
+		return nil, nil
+	}
+	n := new(elNat)
+	n.egress = cfg.Nat
+	for _, addr := range []string{cfg.Addr, cfg.Addr6} {
+		if addr == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		n.subnets = append(n.subnets, subnet)
+	}
+	return n, nil
+}
+
+func (n *elNat) forwardSysctls() []string {
+	keys := []string{"net/ipv4/ip_forward"}
+	for _, subnet := range n.subnets {
+		if subnet.IP.To4() == nil {
+			keys = append(keys, "net/ipv6/conf/all/forwarding")
+			break
+		}
+	}
+	return keys
+}
+
+// the masquerade rules, for the server firewall to set up
+func (n *elNat) rules() []fwRule {
+	rules := make([]fwRule, 0, len(n.subnets))
+	for _, subnet := range n.subnets {
+		rules = append(rules, masqueradeRule(subnet, n.egress))
+	}
+	return rules
+}
+
+// the sysctls setup would change, for -dry-run
+func (n *elNat) describe() string {
+	buf := new(bytes.Buffer)
+	for _, key := range n.forwardSysctls() {
+		fmt.Fprintf(buf, "sysctl -w %s=1\n", strings.Replace(key, "/", ".", -1))
+	}
+	return buf.String()
+}
+
+// turn on forwarding, the rules are up to the firewall
+func (n *elNat) setup() error {
+	n.sysctls = make(map[string]string)
+	for _, key := range n.forwardSysctls() {
+		path := "/proc/sys/" + key
+		old, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(old)) == "1" {
+			continue
+		}
+		logger.Info("sysctl %s=1", key)
+		if err = os.WriteFile(path, []byte("1"), 0644); err != nil {
+			return err
+		}
+		n.sysctls[path] = string(old)
+	}
+	logger.Info("masquerading %v out of %s", n.subnets, n.egress)
+	return nil
+}
+
+// put back the sysctls setup changed
+func (n *elNat) cleanUp() {
+	for path, old := range n.sysctls {
+		logger.Info("restoring %s", path)
+		if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+			logger.Warning(err.Error())
+		}
+	}
+}
+
+// the firewall rules of a server, nil for none
+func serverFirewallRules(cfg ElServerConfig, iface string, n *elNat) []fwRule {
+	var rules []fwRule
+	if mode, _ := parseMSSClamp(cfg.Mss_clamp); cfg.FixMSS && mode == MSS_CLAMP_FIREWALL {
+		rules = append(rules, mssRules(iface, true, cfg.Addr6 != "")...)
+	}
+	if n != nil {
+		rules = append(rules, n.rules()...)
+	}
+	return rules
+}
+
+// DryRun prints the firewall rules and sysctls the server would set up
+// for cfg, without touching any
+func DryRun(icfg interface{}) error {
+	cfg, ok := icfg.(ElServerConfig)
+	if !ok {
+		return fmt.Errorf("dry run needs a server config")
+	}
+	n, err := newElNat(cfg)
+	if err != nil {
+		return err
+	}
+	// the kernel names the tun device once it's created
+	rules := serverFirewallRules(cfg, "tun0", n)
+	if len(rules) == 0 {
+		fmt.Println("# no firewall rules")
+		return nil
+	}
+	if n != nil {
+		fmt.Print(n.describe())
+	}
+	fmt.Println("# with tun0 as the tunnel device")
+	fw, err := newFirewall(cfg.Firewall, "server")
+	if err != nil {
+		return err
+	}
+	fmt.Print(fw.script(rules))
+	return nil
+}
@@ -0,0 +1,72 @@
+package el
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_Nat_Rules(t *testing.T) {
+	var cfg ElServerConfig
+	cfg.Addr = "10.1.1.1/24"
+	cfg.Addr6 = "fd00:1::1/64"
+	cfg.Nat = "eth0"
+	cfg.FixMSS = true
+	cfg.Mss_clamp = "firewall"
+	n, err := newElNat(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := n.describe()
+	for _, want := range []string{
+		"sysctl -w net.ipv4.ip_forward=1\n",
+		"sysctl -w net.ipv6.conf.all.forwarding=1\n",
+	} {
+		if !strings.Contains(desc, want) {
+			t.Errorf("missing %q in\n%s", want, desc)
+		}
+	}
+	rules := serverFirewallRules(cfg, "tun0", n)
+
+	script := newNftFirewall("server").script(rules)
+	for _, want := range []string{
+		"table inet elvpn_server\ndelete table inet elvpn_server\n",
+		"ip saddr 10.1.1.0/24 oifname \"eth0\" masquerade",
+		"ip6 saddr fd00:1::/64 oifname \"eth0\" masquerade",
+		"meta nfproto ipv4 iifname \"tun0\" tcp flags & (syn | rst) == syn tcp option maxseg size set",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("missing %q in\n%s", want, script)
+		}
+	}
+
+	fw := newIptablesFirewall("legacy", "server")
+	v4 := fw.restore(4, rules)
+	for _, want := range []string{
+		"*nat\n:ELVPN-SERVER-POSTROUTING - [0:0]\n",
+		"-A ELVPN-SERVER-POSTROUTING -s 10.1.1.0/24 -o eth0 -j MASQUERADE\n",
+		"-A ELVPN-SERVER-FORWARD -i tun0 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS",
+	} {
+		if !strings.Contains(v4, want) {
+			t.Errorf("missing %q in\n%s", want, v4)
+		}
+	}
+	if strings.Contains(v4, "fd00:1::") {
+		t.Errorf("ipv6 rule in\n%s", v4)
+	}
+	if script = fw.script(rules); !strings.Contains(script, "ip6tables-legacy-restore --noflush") {
+		t.Errorf("wrong command in\n%s", script)
+	}
+
+	// no ip6tables needed without ipv6 in the tunnel
+	if hasFamily(mssRules("tun0", false, false), 6) {
+		t.Error("ipv6 mss rule without ipv6")
+	}
+
+	cfg.Nat = ""
+	if n, _ = newElNat(cfg); n != nil {
+		t.Error("nat without the option")
+	}
+	if _, err = newFirewall("ipchains", "server"); err != invalidFirewall {
+		t.Errorf("got %v, want %v", err, invalidFirewall)
+	}
+}
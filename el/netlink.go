@@ -0,0 +1,331 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// links, addresses, routes and rules over netlink
+
+package el
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// NetlinkError is what a netlink request failed with, the errno is
+// unwrapped so errors.Is(err, syscall.EPERM) and the like work
+type NetlinkError struct {
+	Op  string
+	Obj string
+	Err error
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Obj, e.Err)
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Err
+}
+
+// one change made, and how to take it back
+type nlChange struct {
+	key    string
+	revert func() error
+}
+
+// elNetlink makes the changes idempotent, adding what's there already
+// or deleting what's gone is no error, and logs the ones it made so
+// they can be rolled back in reverse on exit
+type elNetlink struct {
+	log   []nlChange
+	_lock sync.Mutex
+}
+
+var rtnl = new(elNetlink)
+
+func (n *elNetlink) record(key string, revert func() error) {
+	defer n._lock.Unlock()
+	n._lock.Lock()
+	n.log = append(n.log, nlChange{key, revert})
+}
+
+// drop a change undone on purpose from the log
+func (n *elNetlink) forget(key string) {
+	defer n._lock.Unlock()
+	n._lock.Lock()
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].key == key {
+			n.log = append(n.log[:i], n.log[i+1:]...)
+			return
+		}
+	}
+}
+
+// undo every change logged, the last one first
+func (n *elNetlink) rollback() {
+	n._lock.Lock()
+	log := n.log
+	n.log = nil
+	n._lock.Unlock()
+
+	for i := len(log) - 1; i >= 0; i-- {
+		logger.Debug("rollback %s", log[i].key)
+		if err := log[i].revert(); err != nil && !isGone(err) {
+			logger.Warning("rollback %s: %v", log[i].key, err)
+		}
+	}
+}
+
+func isExist(err error) bool {
+	return errors.Is(err, syscall.EEXIST)
+}
+
+func isGone(err error) bool {
+	var lnf netlink.LinkNotFoundError
+	return errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.ENODEV) ||
+		errors.As(err, &lnf)
+}
+
+func (n *elNetlink) link(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, &NetlinkError{"link", name, err}
+	}
+	return link, nil
+}
+
+// bring a link up with mtu and txqueuelen, qlen 0 leaves it
+func (n *elNetlink) linkUp(name string, mtu, qlen int) error {
+	link, err := n.link(name)
+	if err != nil {
+		return err
+	}
+	if err = n.linkMTU(name, mtu); err != nil {
+		return err
+	}
+	if qlen > 0 {
+		logger.Info("link set dev %s txqueuelen %d", name, qlen)
+		if err = netlink.LinkSetTxQLen(link, qlen); err != nil {
+			return &NetlinkError{"link set txqueuelen", name, err}
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		return nil
+	}
+	logger.Info("link set dev %s up", name)
+	if err = netlink.LinkSetUp(link); err != nil {
+		return &NetlinkError{"link set up", name, err}
+	}
+	n.record("link up "+name, func() error { return netlink.LinkSetDown(link) })
+	return nil
+}
+
+func (n *elNetlink) linkMTU(name string, mtu int) error {
+	link, err := n.link(name)
+	if err != nil {
+		return err
+	}
+	old := link.Attrs().MTU
+	if old == mtu {
+		return nil
+	}
+	logger.Info("link set dev %s mtu %d", name, mtu)
+	if err = netlink.LinkSetMTU(link, mtu); err != nil {
+		return &NetlinkError{"link set mtu", name, err}
+	}
+	n.record("link mtu "+name, func() error { return netlink.LinkSetMTU(link, old) })
+	return nil
+}
+
+func (n *elNetlink) linkMaster(name, master string) error {
+	link, err := n.link(name)
+	if err != nil {
+		return err
+	}
+	bridge, err := n.link(master)
+	if err != nil {
+		return err
+	}
+	if link.Attrs().MasterIndex == bridge.Attrs().Index {
+		return nil
+	}
+	logger.Info("link set dev %s master %s", name, master)
+	if err = netlink.LinkSetMaster(link, bridge); err != nil {
+		return &NetlinkError{"link set master", name, err}
+	}
+	n.record("link master "+name, func() error { return netlink.LinkSetNoMaster(link) })
+	return nil
+}
+
+// add addr to a link, with a peer for point to point ones
+func (n *elNetlink) addrAdd(name string, addr, peer *net.IPNet) error {
+	link, err := n.link(name)
+	if err != nil {
+		return err
+	}
+	a := &netlink.Addr{IPNet: addr, Peer: peer}
+	obj := addr.String() + " dev " + name
+	if peer != nil {
+		obj = fmt.Sprintf("%s peer %s dev %s", addr, peer, name)
+	}
+	logger.Info("addr add %s", obj)
+	if err = netlink.AddrAdd(link, a); err != nil {
+		if isExist(err) {
+			return nil
+		}
+		return &NetlinkError{"addr add", obj, err}
+	}
+	n.record("addr "+obj, func() error { return netlink.AddrDel(link, a) })
+	return nil
+}
+
+func routeString(r *netlink.Route) string {
+	s := r.Dst.String()
+	if r.Gw != nil {
+		s += " via " + r.Gw.String()
+	}
+	if r.LinkIndex > 0 {
+		if link, err := netlink.LinkByIndex(r.LinkIndex); err == nil {
+			s += " dev " + link.Attrs().Name
+		}
+	}
+	if r.Table > 0 {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	return s
+}
+
+func (n *elNetlink) routeAdd(r *netlink.Route) error {
+	obj := routeString(r)
+	logger.Info("route add %s", obj)
+	if err := netlink.RouteAdd(r); err != nil {
+		if isExist(err) {
+			return nil
+		}
+		return &NetlinkError{"route add", obj, err}
+	}
+	key := "route " + r.Dst.String()
+	if r.Table > 0 {
+		key += fmt.Sprintf(" table %d", r.Table)
+	}
+	n.record(key, func() error { return netlink.RouteDel(r) })
+	return nil
+}
+
+// delete the route to dst, whatever its next hop
+func (n *elNetlink) routeDel(dst *net.IPNet) error {
+	n.forget("route " + dst.String())
+	logger.Info("route del %s", dst)
+	if err := netlink.RouteDel(&netlink.Route{Dst: dst}); err != nil && !isGone(err) {
+		return &NetlinkError{"route del", dst.String(), err}
+	}
+	return nil
+}
+
+// key of a route list route in the log, apart from the single routes
+func routeListKey(dst *net.IPNet, metric int) string {
+	return fmt.Sprintf("route %s metric %d", dst, metric)
+}
+
+// add routes to dests via gw (on link if nil) on iface, all on one
+// socket and without logging each of them, returns the ones added. a
+// route already there isn't ours and is left out, to not be deleted
+// later.
+func (n *elNetlink) routeListAdd(dests []*net.IPNet, gw net.IP, iface string, metric int) ([]*net.IPNet, error) {
+	link, err := n.link(iface)
+	if err != nil {
+		return nil, err
+	}
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return nil, &NetlinkError{"route add", iface, err}
+	}
+	defer h.Close()
+
+	start := time.Now()
+	added := make([]*net.IPNet, 0, len(dests))
+	var failed int
+	var firstErr error
+	for _, dst := range dests {
+		r := listRoute(dst, gw, link.Attrs().Index, metric)
+		if err = h.RouteAdd(r); err != nil {
+			if isExist(err) {
+				continue
+			}
+			failed++
+			if firstErr == nil {
+				firstErr = &NetlinkError{"route add", routeString(r), err}
+			}
+			logger.Debug("route add %s: %v", dst, err)
+			continue
+		}
+		n.record(routeListKey(dst, metric), func() error { return netlink.RouteDel(r) })
+		added = append(added, dst)
+	}
+	logger.Debug("%d routes added in %v", len(added), time.Since(start))
+	if failed > 0 {
+		return added, fmt.Errorf("%d of %d routes failed, first %w", failed, len(dests), firstErr)
+	}
+	return added, nil
+}
+
+// delete the routes routeListAdd added
+func (n *elNetlink) routeListDel(dests []*net.IPNet, gw net.IP, iface string, metric int) error {
+	for _, dst := range dests {
+		n.forget(routeListKey(dst, metric))
+	}
+	link, err := n.link(iface)
+	if err != nil {
+		return err
+	}
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return &NetlinkError{"route del", iface, err}
+	}
+	defer h.Close()
+
+	var failed int
+	var firstErr error
+	for _, dst := range dests {
+		r := listRoute(dst, gw, link.Attrs().Index, metric)
+		if err = h.RouteDel(r); err != nil && !isGone(err) {
+			failed++
+			if firstErr == nil {
+				firstErr = &NetlinkError{"route del", routeString(r), err}
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d routes failed, first %w", failed, len(dests), firstErr)
+	}
+	return nil
+}
+
+func listRoute(dst *net.IPNet, gw net.IP, ifindex, metric int) *netlink.Route {
+	r := &netlink.Route{Dst: dst, Gw: gw, LinkIndex: ifindex, Priority: metric}
+	if gw == nil {
+		r.Scope = netlink.SCOPE_LINK
+	}
+	return r
+}
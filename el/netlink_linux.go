@@ -0,0 +1,73 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// netlink rules, which the netlink package has on linux only
+
+package el
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// address families of routes and rules
+const (
+	FAMILY_V4 = netlink.FAMILY_V4
+	FAMILY_V6 = netlink.FAMILY_V6
+)
+
+func ruleString(r *netlink.Rule) string {
+	s := fmt.Sprintf("prio %d", r.Priority)
+	if r.Family == FAMILY_V6 {
+		s = "-6 " + s
+	}
+	if r.Invert {
+		s += " not"
+	}
+	if r.Mark != 0 {
+		s += fmt.Sprintf(" fwmark 0x%x", r.Mark)
+	}
+	if r.SuppressPrefixlen >= 0 {
+		s += fmt.Sprintf(" suppress_prefixlength %d", r.SuppressPrefixlen)
+	}
+	return s + fmt.Sprintf(" table %d", r.Table)
+}
+
+func (n *elNetlink) ruleAdd(r *netlink.Rule) error {
+	obj := ruleString(r)
+	logger.Info("rule add %s", obj)
+	if err := netlink.RuleAdd(r); err != nil {
+		if isExist(err) {
+			return nil
+		}
+		return &NetlinkError{"rule add", obj, err}
+	}
+	n.record("rule "+obj, func() error { return netlink.RuleDel(r) })
+	return nil
+}
+
+func (n *elNetlink) ruleDel(r *netlink.Rule) error {
+	obj := ruleString(r)
+	n.forget("rule " + obj)
+	logger.Info("rule del %s", obj)
+	if err := netlink.RuleDel(r); err != nil && !isGone(err) {
+		return &NetlinkError{"rule del", obj, err}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// client configuration pushed in the handshake ack
+
+package el
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+// the handshake ack payload is [version][ipv4 address 4][prefix len]
+// followed by options, every option is [type][value len][value] and
+// clients skip the types they don't know
+const (
+	HOP_OPT_IP6       byte = 0x01 // ipv6 address 16, prefix len
+	HOP_OPT_GATEWAY   byte = 0x02 // server's tunnel address to route via
+	HOP_OPT_ROUTE     byte = 0x03 // address 4 or 16, prefix len
+	HOP_OPT_DNS       byte = 0x04 // address 4 or 16
+	HOP_OPT_DOMAIN    byte = 0x05 // search domain
+	HOP_OPT_MTU       byte = 0x06 // uint16
+	HOP_OPT_HEARTBEAT byte = 0x07 // uint16 seconds
+	HOP_OPT_REDIRECT  byte = 0x08 // 1 to redirect the gateway, 0 not to
+	HOP_OPT_TOPOLOGY  byte = 0x09 // TOPOLOGY_*
+
+	// options beyond this are left out to keep the ack in one packet
+	HOP_OPT_MAX_LEN = 1024
+)
+
+type elOptions struct {
+	ip6       *net.IPNet
+	gateway   net.IP
+	routes    []*net.IPNet
+	dns       []net.IP
+	domains   []string
+	mtu       int
+	heartbeat int
+	// nil if the server leaves it to the client
+	redirect *bool
+	topology int
+}
+
+func newElOptions() *elOptions {
+	o := new(elOptions)
+	o.topology = -1
+	return o
+}
+
+func writeOption(buf *bytes.Buffer, t byte, v []byte) {
+	if len(v) > 0xff || buf.Len()+len(v)+2 > HOP_OPT_MAX_LEN {
+		logger.Warning("option %d of %d bytes left out of the handshake", t, len(v))
+		return
+	}
+	buf.WriteByte(t)
+	buf.WriteByte(byte(len(v)))
+	buf.Write(v)
+}
+
+func prefixBytes(n *net.IPNet) []byte {
+	ip := []byte(n.IP.To4())
+	if ip == nil {
+		ip = []byte(n.IP.To16())
+	}
+	plen, _ := n.Mask.Size()
+	return append(append([]byte{}, ip...), byte(plen))
+}
+
+func parsePrefix(v []byte) *net.IPNet {
+	if len(v) != net.IPv4len+1 && len(v) != net.IPv6len+1 {
+		return nil
+	}
+	bits := (len(v) - 1) * 8
+	plen := int(v[len(v)-1])
+	if plen > bits {
+		return nil
+	}
+	ip := net.IP(append([]byte{}, v[:len(v)-1]...))
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(plen, bits)}
+}
+
+func (o *elOptions) encode(buf *bytes.Buffer) {
+	opts := new(bytes.Buffer)
+	if o.ip6 != nil {
+		writeOption(opts, HOP_OPT_IP6, prefixBytes(o.ip6))
+	}
+	if o.gateway != nil {
+		writeOption(opts, HOP_OPT_GATEWAY, []byte(o.gateway.To4()))
+	}
+	if o.topology >= 0 {
+		writeOption(opts, HOP_OPT_TOPOLOGY, []byte{byte(o.topology)})
+	}
+	if o.mtu > 0 {
+		v := make([]byte, 2)
+		binary.BigEndian.PutUint16(v, uint16(o.mtu))
+		writeOption(opts, HOP_OPT_MTU, v)
+	}
+	if o.heartbeat > 0 {
+		v := make([]byte, 2)
+		binary.BigEndian.PutUint16(v, uint16(o.heartbeat))
+		writeOption(opts, HOP_OPT_HEARTBEAT, v)
+	}
+	if o.redirect != nil {
+		v := byte(0)
+		if *o.redirect {
+			v = 1
+		}
+		writeOption(opts, HOP_OPT_REDIRECT, []byte{v})
+	}
+	for _, dns := range o.dns {
+		if ip4 := dns.To4(); ip4 != nil {
+			writeOption(opts, HOP_OPT_DNS, []byte(ip4))
+		} else {
+			writeOption(opts, HOP_OPT_DNS, []byte(dns.To16()))
+		}
+	}
+	for _, domain := range o.domains {
+		writeOption(opts, HOP_OPT_DOMAIN, []byte(domain))
+	}
+	for _, route := range o.routes {
+		writeOption(opts, HOP_OPT_ROUTE, prefixBytes(route))
+	}
+	buf.Write(opts.Bytes())
+}
+
+// parse an options block, malformed options are skipped and a
+// truncated one ends it
+func parseOptions(b []byte) *elOptions {
+	o := newElOptions()
+	for len(b) >= 2 {
+		t, l := b[0], int(b[1])
+		if len(b) < 2+l {
+			logger.Warning("truncated option %d", t)
+			break
+		}
+		v := b[2 : 2+l]
+		b = b[2+l:]
+
+		switch t {
+		case HOP_OPT_IP6:
+			if n := parsePrefix(v); n != nil && len(v) == net.IPv6len+1 {
+				o.ip6 = n
+			}
+		case HOP_OPT_GATEWAY:
+			if len(v) == net.IPv4len {
+				o.gateway = net.IP(append([]byte{}, v...))
+			}
+		case HOP_OPT_ROUTE:
+			if n := parsePrefix(v); n != nil {
+				o.routes = append(o.routes, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+			}
+		case HOP_OPT_DNS:
+			if len(v) == net.IPv4len || len(v) == net.IPv6len {
+				o.dns = append(o.dns, net.IP(append([]byte{}, v...)))
+			}
+		case HOP_OPT_DOMAIN:
+			if len(v) > 0 {
+				o.domains = append(o.domains, string(v))
+			}
+		case HOP_OPT_MTU:
+			if len(v) == 2 {
+				o.mtu = int(binary.BigEndian.Uint16(v))
+			}
+		case HOP_OPT_HEARTBEAT:
+			if len(v) == 2 {
+				o.heartbeat = int(binary.BigEndian.Uint16(v))
+			}
+		case HOP_OPT_REDIRECT:
+			if len(v) == 1 {
+				redirect := v[0] != 0
+				o.redirect = &redirect
+			}
+		case HOP_OPT_TOPOLOGY:
+			if len(v) == 1 {
+				o.topology = int(v[0])
+			}
+		default:
+			logger.Debug("unknown option %d", t)
+		}
+	}
+	return o
+}
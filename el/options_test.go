@@ -0,0 +1,49 @@
+package el
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func Test_Options_RoundTrip(t *testing.T) {
+	_, ip6, _ := net.ParseCIDR("fd00:1::5/64")
+	ip6.IP = net.ParseIP("fd00:1::5")
+	_, r4, _ := net.ParseCIDR("192.168.50.0/24")
+	_, r6, _ := net.ParseCIDR("fd00:50::/48")
+	redirect := true
+
+	o := newElOptions()
+	o.ip6 = ip6
+	o.gateway = net.ParseIP("10.1.1.1")
+	o.routes = []*net.IPNet{r4, r6}
+	o.dns = []net.IP{net.ParseIP("10.1.1.1"), net.ParseIP("fd00:1::1")}
+	o.domains = []string{"corp.example"}
+	o.mtu = 1380
+	o.heartbeat = 10
+	o.redirect = &redirect
+	o.topology = TOPOLOGY_SUBNET
+
+	buf := new(bytes.Buffer)
+	o.encode(buf)
+	// an option from a newer server, then a truncated one
+	b := append(buf.Bytes(), 0xee, 2, 1, 2)
+	p := parseOptions(append(b, HOP_OPT_MTU, 2, 0x05))
+
+	if p.ip6.String() != ip6.String() || !p.gateway.Equal(o.gateway) {
+		t.Errorf("addresses: got %v %v", p.ip6, p.gateway)
+	}
+	if len(p.routes) != 2 || p.routes[0].String() != r4.String() || p.routes[1].String() != r6.String() {
+		t.Errorf("routes: got %v", p.routes)
+	}
+	if len(p.dns) != 2 || !p.dns[1].Equal(o.dns[1]) || len(p.domains) != 1 || p.domains[0] != "corp.example" {
+		t.Errorf("dns: got %v %v", p.dns, p.domains)
+	}
+	if p.mtu != 1380 || p.heartbeat != 10 || p.redirect == nil || !*p.redirect || p.topology != TOPOLOGY_SUBNET {
+		t.Errorf("got mtu %d, heartbeat %d, redirect %v, topology %d", p.mtu, p.heartbeat, p.redirect, p.topology)
+	}
+
+	if p := parseOptions(nil); p.redirect != nil || p.topology != -1 || p.mtu != 0 {
+		t.Error("empty options set something")
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// packet buffers recycling
+
+package el
+
+import (
+	"sync"
+)
+
+// pooled arrays are kept as pointers so that Put doesn't allocate
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new([IFACE_BUFSIZE]byte)
+	},
+}
+
+// get a buffer of IFACE_BUFSIZE bytes
+func getBuffer() []byte {
+	return bufPool.Get().(*[IFACE_BUFSIZE]byte)[:]
+}
+
+// get a buffer of n bytes, from the pool if it fits
+func getBufferSize(n int) []byte {
+	if n > IFACE_BUFSIZE {
+		return make([]byte, n)
+	}
+	return getBuffer()[:n]
+}
+
+// give back a buffer got from getBuffer, b must start where the
+// pooled buffer starts, buffers of other sizes are left to the GC
+func putBuffer(b []byte) {
+	if cap(b) != IFACE_BUFSIZE {
+		return
+	}
+	bufPool.Put((*[IFACE_BUFSIZE]byte)(b[:IFACE_BUFSIZE]))
+}
@@ -21,7 +21,6 @@
 package el
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
@@ -65,6 +64,27 @@ type elPacketHeader struct {
 	Dlen       uint16
 }
 
+// encode header into the first HOP_HDR_LEN bytes of b
+func (p *elPacketHeader) encode(b []byte) {
+	b[0] = p.Flag
+	binary.BigEndian.PutUint32(b[1:5], p.Seq)
+	binary.BigEndian.PutUint16(b[5:7], p.Plen)
+	binary.BigEndian.PutUint16(b[7:9], p.FragPrefix)
+	b[9] = p.Frag
+	binary.BigEndian.PutUint32(b[10:14], p.Sid)
+	binary.BigEndian.PutUint16(b[14:16], p.Dlen)
+}
+
+func (p *elPacketHeader) decode(b []byte) {
+	p.Flag = b[0]
+	p.Seq = binary.BigEndian.Uint32(b[1:5])
+	p.Plen = binary.BigEndian.Uint16(b[5:7])
+	p.FragPrefix = binary.BigEndian.Uint16(b[7:9])
+	p.Frag = b[9]
+	p.Sid = binary.BigEndian.Uint32(b[10:14])
+	p.Dlen = binary.BigEndian.Uint16(b[14:16])
+}
+
 func (p elPacketHeader) String() string {
 	flag := make([]string, 0, 8)
 	if (p.Flag^HOP_FLG_MFR == 0) || (p.Flag == 0) {
@@ -98,27 +118,39 @@ type ElPacket struct {
 	payload []byte
 	noise   []byte
 	buf     []byte
+	// buf comes from the buffer pool
+	pooled bool
 }
 
 var cipher *elCipher
 
+// Pack returns the encrypted packet in a pooled buffer,
+// put it back with putBuffer once it's sent
 func (p *ElPacket) Pack() []byte {
 	p.Dlen = uint16(len(p.payload))
-	var buf *bytes.Buffer
 	if p.buf != nil {
 		// reduce memcopy
-		buf = bytes.NewBuffer(p.buf[:0])
-		binary.Write(buf, binary.BigEndian, p.elPacketHeader)
+		p.elPacketHeader.encode(p.buf)
 	} else {
-		buf = bytes.NewBuffer(make([]byte, 0, p.Size()))
-		binary.Write(buf, binary.BigEndian, p.elPacketHeader)
-		buf.Write(p.payload)
-		buf.Write(p.noise)
-		p.buf = buf.Bytes()
+		buf := make([]byte, p.Size())
+		p.elPacketHeader.encode(buf)
+		copy(buf[HOP_HDR_LEN:], p.payload)
+		copy(buf[HOP_HDR_LEN+len(p.payload):], p.noise)
+		p.buf = buf
 	}
 	return cipher.encrypt(p.buf)
 }
 
+// give the packet's buffer back to the pool,
+// the packet must not be used afterwards
+func (p *ElPacket) release() {
+	if p.pooled {
+		putBuffer(p.buf)
+	}
+	p.buf, p.payload, p.noise = nil, nil, nil
+	p.pooled = false
+}
+
 func (p *ElPacket) Size() int {
 	return HOP_HDR_LEN + len(p.payload) + len(p.noise)
 }
@@ -153,12 +185,22 @@ func unpackElPacket(b []byte) (*ElPacket, error) {
 	iv := b[:cipherBlockSize]
 	ctext := b[cipherBlockSize:]
 	if frame := cipher.decrypt(iv, ctext); frame != nil {
-		buf := bytes.NewBuffer(frame)
+		if len(frame) < HOP_HDR_LEN {
+			putBuffer(frame)
+			return nil, errors.New("Short Packet")
+		}
 
 		p := new(ElPacket)
-		binary.Read(buf, binary.BigEndian, &p.elPacketHeader)
-		p.payload = make([]byte, p.Dlen)
-		buf.Read(p.payload)
+		p.elPacketHeader.decode(frame)
+		if end := HOP_HDR_LEN + int(p.Dlen); end <= len(frame) {
+			p.payload = frame[HOP_HDR_LEN:end]
+		} else {
+			p.payload = frame[HOP_HDR_LEN:]
+		}
+		// payload stays in the decrypted buffer, it's released
+		// along with the packet
+		p.buf = frame
+		p.pooled = true
 		return p, nil
 	} else {
 		return nil, errors.New("Decrypt Packet Error")
@@ -166,18 +208,19 @@ func unpackElPacket(b []byte) (*ElPacket, error) {
 
 }
 
-func udpAddrHash(a *net.UDPAddr) [6]byte {
-	var b [6]byte
-	copy(b[:4], []byte(a.IP)[:4])
+// full 16 byte address and port, IPv4 addresses are v4-mapped
+func udpAddrHash(a *net.UDPAddr) [18]byte {
+	var b [18]byte
+	copy(b[:16], []byte(a.IP.To16()))
 	p := uint16(a.Port)
-	b[4] = byte((p >> 8) & 0xFF)
-	b[5] = byte(p & 0xFF)
+	b[16] = byte((p >> 8) & 0xFF)
+	b[17] = byte(p & 0xFF)
 	return b
 }
 
 type hUDPAddr struct {
 	u    *net.UDPAddr
-	hash [6]byte
+	hash [18]byte
 }
 
 func newhUDPAddr(a *net.UDPAddr) *hUDPAddr {
@@ -186,14 +229,21 @@ func newhUDPAddr(a *net.UDPAddr) *hUDPAddr {
 
 // goel Peer is a record of a peer's available UDP addrs
 type ElPeer struct {
-	id           uint64
-	ip           net.IP
-	addrs        map[[6]byte]int
-	_addrs_lst   []*hUDPAddr // i know it's ugly!
-	seq          uint32
-	state        int32
-	hsDone       chan struct{} // Handshake done
-	recvBuffer   *elPacketBuffer
+	id  uint64
+	ip  net.IP
+	ip6 net.IP
+	// name the client sent in its handshake, if any
+	name       string
+	addrs      map[[18]byte]int
+	_addrs_lst []*hUDPAddr // i know it's ugly!
+	seq        uint32
+	state      int32
+	hsDone     chan struct{} // Handshake done
+	recvBuffer *elPacketBuffer
+	// device frames waiting to be encrypted and sent to this peer
+	fromIface    *elQueue
+	done         chan struct{}
+	_stop        sync.Once
 	srv          *ElServer
 	_lock        sync.RWMutex
 	lastSeenTime time.Time
@@ -203,20 +253,47 @@ func newElPeer(id uint64, srv *ElServer, addr *net.UDPAddr, idx int) *ElPeer {
 	hp := new(ElPeer)
 	hp.id = id
 	hp._addrs_lst = make([]*hUDPAddr, 0)
-	hp.addrs = make(map[[6]byte]int)
+	hp.addrs = make(map[[18]byte]int)
 	hp.state = HOP_STAT_INIT
 	hp.seq = 0
 	hp.srv = srv
-	hp.recvBuffer = newElPacketBuffer(srv.toIface)
+	hp.recvBuffer = newElPacketBuffer(func(p *ElPacket) {
+		srv.toDevice(id, p)
+	}, srv.cfg.QueueLen)
+	hp.fromIface = newElQueue(fmt.Sprintf("peer[%d]", id>>32), srv.cfg.QueueLen, QUEUE_DROP_TAIL)
+	hp.done = make(chan struct{})
 	// logger.Debug("%v, %v", hp.recvBuffer, hp.srv)
 
 	a := newhUDPAddr(addr)
 	hp._addrs_lst = append(hp._addrs_lst, a)
 	hp.addrs[a.hash] = idx
 
+	go hp.forwardFrames()
+
 	return hp
 }
 
+// encrypt and send device frames to the peer, one goroutine per peer
+// keeps its frames in order while peers are served in parallel
+func (h *ElPeer) forwardFrames() {
+	for {
+		select {
+		case it := <-h.fromIface.C():
+			pack := h.fromIface.Done(it).([]byte)
+			h.srv.bufferToClient(h, pack)
+			putBuffer(pack)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *ElPeer) stop() {
+	h._stop.Do(func() {
+		close(h.done)
+	})
+}
+
 func (h *ElPeer) Seq() uint32 {
 	return atomic.AddUint32(&h.seq, 1)
 }
@@ -0,0 +1,82 @@
+package el
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Pack_Unpack(t *testing.T) {
+	var err error
+	cipher, err = newElCipher([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := getBuffer()
+	frame := buf[:HOP_HDR_LEN+1000]
+	for i := range frame[HOP_HDR_LEN:] {
+		frame[HOP_HDR_LEN+i] = byte(i % 256)
+	}
+
+	hp := new(ElPacket)
+	hp.Flag = HOP_FLG_DAT
+	hp.Seq = 42
+	hp.Sid = 0xdeadbeef
+	hp.buf = frame
+	hp.payload = frame[HOP_HDR_LEN:]
+	hp.pooled = true
+
+	data := hp.Pack()
+	p, err := unpackElPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putBuffer(data)
+
+	if p.Flag != HOP_FLG_DAT || p.Seq != 42 || p.Sid != 0xdeadbeef {
+		t.Errorf("header mismatch: %v", p.elPacketHeader)
+	}
+	if !bytes.Equal(p.payload, hp.payload) {
+		t.Errorf("payload mismatch")
+	}
+	p.release()
+	hp.release()
+}
+
+// steady state forwarding should allocate next to nothing,
+// check with -benchmem
+
+func BenchmarkPack(b *testing.B) {
+	cipher, _ = newElCipher([]byte("benchmark"))
+	b.ReportAllocs()
+	b.SetBytes(int64(MTU))
+	for i := 0; i < b.N; i++ {
+		buf := getBuffer()
+		hp := new(ElPacket)
+		hp.Flag = HOP_FLG_DAT
+		hp.buf = buf[:HOP_HDR_LEN+MTU]
+		hp.payload = hp.buf[HOP_HDR_LEN:]
+		hp.pooled = true
+		putBuffer(hp.Pack())
+		hp.release()
+	}
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	cipher, _ = newElCipher([]byte("benchmark"))
+	hp := new(ElPacket)
+	hp.Flag = HOP_FLG_DAT
+	hp.setPayload(make([]byte, MTU))
+	data := hp.Pack()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(MTU))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p, err := unpackElPacket(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.release()
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// bounded packet queues with explicit drop policies
+
+package el
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	QUEUE_DROP_TAIL int = iota // drop the incoming packet when full
+	QUEUE_DROP_HEAD            // drop the oldest queued packet when full
+	QUEUE_DROP_FAIR            // drop packets of owners above their fair share
+
+	QUEUE_DEFAULT_LEN = 2048
+)
+
+var invalidDropPolicy = errors.New("Invalid drop policy")
+
+func parseDropPolicy(s string) (int, error) {
+	switch s {
+	case "", "tail":
+		return QUEUE_DROP_TAIL, nil
+	case "head":
+		return QUEUE_DROP_HEAD, nil
+	case "fair":
+		return QUEUE_DROP_FAIR, nil
+	default:
+		return 0, invalidDropPolicy
+	}
+}
+
+type elQueueItem struct {
+	owner uint64
+	p     interface{}
+}
+
+// elQueue never blocks its producers, when it's full a packet is dropped
+// according to the policy and counted, so a stalled consumer can only
+// lose its own packets instead of freezing whoever feeds it.
+type elQueue struct {
+	name   string
+	ch     chan elQueueItem
+	policy int
+	// queued packets per owner, only tracked by QUEUE_DROP_FAIR
+	owners map[uint64]int
+	_lock  sync.Mutex
+
+	enqueued uint64
+	dropped  uint64
+}
+
+func newElQueue(name string, size int, policy int) *elQueue {
+	if size <= 0 {
+		size = QUEUE_DEFAULT_LEN
+	}
+	q := new(elQueue)
+	q.name = name
+	q.ch = make(chan elQueueItem, size)
+	q.policy = policy
+	q.owners = make(map[uint64]int)
+	return q
+}
+
+// Push enqueues p on behalf of owner, returns false if a packet
+// of this owner was dropped instead
+func (q *elQueue) Push(owner uint64, p interface{}) bool {
+	switch q.policy {
+	case QUEUE_DROP_HEAD:
+		return q.pushHead(owner, p)
+	case QUEUE_DROP_FAIR:
+		return q.pushFair(owner, p)
+	default:
+		return q.pushTail(owner, p)
+	}
+}
+
+func (q *elQueue) pushTail(owner uint64, p interface{}) bool {
+	select {
+	case q.ch <- elQueueItem{owner, p}:
+		atomic.AddUint64(&q.enqueued, 1)
+		return true
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		return false
+	}
+}
+
+func (q *elQueue) pushHead(owner uint64, p interface{}) bool {
+	for i := 0; i < 2; i++ {
+		select {
+		case q.ch <- elQueueItem{owner, p}:
+			atomic.AddUint64(&q.enqueued, 1)
+			return true
+		default:
+		}
+		// full, make room by throwing away the oldest packet
+		select {
+		case <-q.ch:
+			atomic.AddUint64(&q.dropped, 1)
+		default:
+		}
+	}
+	atomic.AddUint64(&q.dropped, 1)
+	return false
+}
+
+func (q *elQueue) pushFair(owner uint64, p interface{}) bool {
+	q._lock.Lock()
+	defer q._lock.Unlock()
+
+	// once the queue is half full, no owner may hold more than
+	// an equal share of it
+	n, size := len(q.ch), cap(q.ch)
+	if n >= size/2 && len(q.owners) > 0 {
+		share := size / len(q.owners)
+		if _, found := q.owners[owner]; !found {
+			share = size / (len(q.owners) + 1)
+		}
+		if q.owners[owner] >= share {
+			atomic.AddUint64(&q.dropped, 1)
+			return false
+		}
+	}
+
+	select {
+	case q.ch <- elQueueItem{owner, p}:
+		q.owners[owner]++
+		atomic.AddUint64(&q.enqueued, 1)
+		return true
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		return false
+	}
+}
+
+// C is the channel to receive from, every item received from it
+// must be passed to Done to get the packet back
+func (q *elQueue) C() <-chan elQueueItem {
+	return q.ch
+}
+
+func (q *elQueue) Done(it elQueueItem) interface{} {
+	if q.policy == QUEUE_DROP_FAIR {
+		q._lock.Lock()
+		if q.owners[it.owner] <= 1 {
+			delete(q.owners, it.owner)
+		} else {
+			q.owners[it.owner]--
+		}
+		q._lock.Unlock()
+	}
+	return it.p
+}
+
+// Pop blocks until a packet is available
+func (q *elQueue) Pop() interface{} {
+	return q.Done(<-q.ch)
+}
+
+// TryPop returns false at once if the queue is empty
+func (q *elQueue) TryPop() (interface{}, bool) {
+	select {
+	case it := <-q.ch:
+		return q.Done(it), true
+	default:
+		return nil, false
+	}
+}
+
+func (q *elQueue) Len() int {
+	return len(q.ch)
+}
+
+func (q *elQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+func (q *elQueue) String() string {
+	return fmt.Sprintf(
+		"{%s: len %d/%d, enqueued %d, dropped %d}",
+		q.name, len(q.ch), cap(q.ch),
+		atomic.LoadUint64(&q.enqueued), atomic.LoadUint64(&q.dropped),
+	)
+}
@@ -0,0 +1,178 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// routes from tunnel addresses and subnets to peers
+
+package el
+
+import (
+	"net"
+	"sync"
+)
+
+// one bit of an address per level, a node holding a peer is the end
+// of a prefix routed to it
+type elRouteNode struct {
+	child [2]*elRouteNode
+	hpeer *ElPeer
+}
+
+// elRouteTable finds the peer behind an address by longest prefix
+// match, a client's own tunnel addresses are host routes, the subnets
+// behind it routes of their own and 0.0.0.0/0 or ::/0 a default route
+type elRouteTable struct {
+	root4 *elRouteNode
+	root6 *elRouteNode
+	_lock sync.RWMutex
+}
+
+func newElRouteTable() *elRouteTable {
+	t := new(elRouteTable)
+	t.root4 = new(elRouteNode)
+	t.root6 = new(elRouteNode)
+	return t
+}
+
+// root and address bits to walk for ip
+func (t *elRouteTable) tree(ip net.IP) (*elRouteNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.root4, ip4
+	}
+	return t.root6, ip.To16()
+}
+
+func addrBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 0x01
+}
+
+// add or replace the route to dest
+func (t *elRouteTable) add(dest *net.IPNet, hpeer *ElPeer) {
+	defer t._lock.Unlock()
+	t._lock.Lock()
+
+	node, ip := t.tree(dest.IP)
+	plen, _ := dest.Mask.Size()
+	for i := 0; i < plen; i++ {
+		b := addrBit(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = new(elRouteNode)
+		}
+		node = node.child[b]
+	}
+	node.hpeer = hpeer
+}
+
+// remove the route to dest
+func (t *elRouteTable) remove(dest *net.IPNet) {
+	defer t._lock.Unlock()
+	t._lock.Lock()
+
+	root, ip := t.tree(dest.IP)
+	plen, _ := dest.Mask.Size()
+	path := make([]*elRouteNode, 0, plen+1)
+	node := root
+	for i := 0; i < plen && node != nil; i++ {
+		path = append(path, node)
+		node = node.child[addrBit(ip, i)]
+	}
+	if node == nil {
+		return
+	}
+	node.hpeer = nil
+	// cut the branches left leading nowhere
+	for i := plen - 1; i >= 0; i-- {
+		if !node.empty() {
+			return
+		}
+		path[i].child[addrBit(ip, i)] = nil
+		node = path[i]
+	}
+}
+
+// remove every route to hpeer
+func (t *elRouteTable) removePeer(hpeer *ElPeer) {
+	defer t._lock.Unlock()
+	t._lock.Lock()
+
+	t.root4.removePeer(hpeer)
+	t.root6.removePeer(hpeer)
+}
+
+// returns true if nothing is left under n
+func (n *elRouteNode) removePeer(hpeer *ElPeer) bool {
+	if n.hpeer == hpeer {
+		n.hpeer = nil
+	}
+	for b, c := range n.child {
+		if c != nil && c.removePeer(hpeer) {
+			n.child[b] = nil
+		}
+	}
+	return n.empty()
+}
+
+func (n *elRouteNode) empty() bool {
+	return n.hpeer == nil && n.child[0] == nil && n.child[1] == nil
+}
+
+func (t *elRouteTable) lookup(ip net.IP) (*ElPeer, bool) {
+	defer t._lock.RUnlock()
+	t._lock.RLock()
+
+	node, ip := t.tree(ip)
+	if ip == nil {
+		return nil, false
+	}
+	hpeer := node.hpeer
+	for i := 0; i < len(ip)*8; i++ {
+		node = node.child[addrBit(ip, i)]
+		if node == nil {
+			break
+		}
+		if node.hpeer != nil {
+			hpeer = node.hpeer
+		}
+	}
+	return hpeer, hpeer != nil
+}
+
+// a host route for a single address
+func hostRoute(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// the iroute sections, checked and keyed by client name
+func parseIroutes(cfg map[string]*ElIrouteConfig) (map[string][]*net.IPNet, error) {
+	iroutes := make(map[string][]*net.IPNet)
+	for name, icfg := range cfg {
+		if icfg == nil {
+			continue
+		}
+		for _, s := range icfg.Subnet {
+			_, subnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			iroutes[name] = append(iroutes[name], subnet)
+		}
+	}
+	return iroutes, nil
+}
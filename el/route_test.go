@@ -0,0 +1,86 @@
+package el
+
+import (
+	"net"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func checkRoute(t *testing.T, table *elRouteTable, ip string, want *ElPeer) {
+	hpeer, found := table.lookup(net.ParseIP(ip))
+	if found != (want != nil) || hpeer != want {
+		t.Errorf("lookup %s: got %v (found %v), want %v", ip, hpeer, found, want)
+	}
+}
+
+func Test_RouteTable_LongestPrefix(t *testing.T) {
+	table := newElRouteTable()
+	host, branch, office, gw := new(ElPeer), new(ElPeer), new(ElPeer), new(ElPeer)
+
+	table.add(hostRoute(net.ParseIP("10.1.1.3")), host)
+	table.add(mustCIDR(t, "192.168.0.0/16"), branch)
+	table.add(mustCIDR(t, "192.168.50.0/24"), office)
+	table.add(mustCIDR(t, "fd00:1::/64"), office)
+	table.add(hostRoute(net.ParseIP("fd00:1::3")), host)
+
+	checkRoute(t, table, "10.1.1.3", host)
+	checkRoute(t, table, "10.1.1.5", nil)
+	checkRoute(t, table, "192.168.50.7", office)
+	checkRoute(t, table, "192.168.51.7", branch)
+	checkRoute(t, table, "fd00:1::3", host)
+	checkRoute(t, table, "fd00:1::4", office)
+	checkRoute(t, table, "fd00:2::4", nil)
+	// v4-mapped v6 addresses are v4 addresses
+	checkRoute(t, table, "::ffff:192.168.50.7", office)
+
+	table.add(mustCIDR(t, "0.0.0.0/0"), gw)
+	checkRoute(t, table, "10.1.1.5", gw)
+	checkRoute(t, table, "192.168.50.7", office)
+	checkRoute(t, table, "fd00:2::4", nil)
+	table.add(mustCIDR(t, "::/0"), gw)
+	checkRoute(t, table, "fd00:2::4", gw)
+
+	// the last one added to a prefix wins
+	table.add(mustCIDR(t, "192.168.50.0/24"), branch)
+	checkRoute(t, table, "192.168.50.7", branch)
+}
+
+func Test_RouteTable_Remove(t *testing.T) {
+	table := newElRouteTable()
+	a, b := new(ElPeer), new(ElPeer)
+
+	table.add(mustCIDR(t, "192.168.0.0/16"), a)
+	table.add(mustCIDR(t, "192.168.50.0/24"), b)
+	table.add(hostRoute(net.ParseIP("10.1.1.3")), b)
+	table.add(hostRoute(net.ParseIP("fd00:1::3")), b)
+
+	// a shorter prefix takes over once the longer one is gone
+	table.remove(mustCIDR(t, "192.168.50.0/24"))
+	checkRoute(t, table, "192.168.50.7", a)
+	checkRoute(t, table, "10.1.1.3", b)
+
+	// removing a route that isn't there changes nothing
+	table.remove(mustCIDR(t, "192.168.50.0/25"))
+	table.remove(mustCIDR(t, "172.16.0.0/12"))
+	checkRoute(t, table, "192.168.50.7", a)
+
+	// a disconnecting peer takes all its routes along
+	table.add(mustCIDR(t, "192.168.50.0/24"), b)
+	table.removePeer(b)
+	checkRoute(t, table, "192.168.50.7", a)
+	checkRoute(t, table, "10.1.1.3", nil)
+	checkRoute(t, table, "fd00:1::3", nil)
+
+	table.removePeer(a)
+	checkRoute(t, table, "192.168.50.7", nil)
+	if !table.root4.empty() || !table.root6.empty() {
+		t.Error("empty table still has nodes")
+	}
+}
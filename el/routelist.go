@@ -0,0 +1,200 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// split tunnel route lists
+
+package el
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// metric of the routes from bypass-routes and include-routes
+const ROUTE_LIST_METRIC = 5
+
+// read CIDR list files, one prefix or address per line and # comments,
+// into as few prefixes as cover them
+func loadRouteLists(files []string) ([]*net.IPNet, error) {
+	var dests []*net.IPNet
+	for _, file := range files {
+		d, err := parseRouteList(file)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, d...)
+	}
+	return aggregateRoutes(dests), nil
+}
+
+func parseRouteList(file string) ([]*net.IPNet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dests []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			ip := net.ParseIP(line)
+			if ip == nil {
+				return nil, fmt.Errorf("%s:%d: invalid address %s", file, lineno, line)
+			}
+			dests = append(dests, hostRoute(ip))
+			continue
+		}
+		_, dest, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, lineno, err)
+		}
+		dests = append(dests, dest)
+	}
+	return dests, scanner.Err()
+}
+
+// one bit of a prefix per level like elRouteNode, a full node covers
+// everything below it
+type prefixNode struct {
+	child [2]*prefixNode
+	full  bool
+}
+
+func (n *prefixNode) insert(ip net.IP, plen int) {
+	for i := 0; i < plen; i++ {
+		if n.full {
+			return
+		}
+		b := addrBit(ip, i)
+		if n.child[b] == nil {
+			n.child[b] = new(prefixNode)
+		}
+		n = n.child[b]
+	}
+	n.full = true
+	n.child = [2]*prefixNode{}
+}
+
+// two full halves make a full node
+func (n *prefixNode) merge() bool {
+	if n == nil {
+		return false
+	}
+	if n.full {
+		return true
+	}
+	// both have to merge their own halves first
+	left, right := n.child[0].merge(), n.child[1].merge()
+	if left && right {
+		n.full = true
+		n.child = [2]*prefixNode{}
+	}
+	return n.full
+}
+
+func (n *prefixNode) collect(ip net.IP, depth int, dests []*net.IPNet) []*net.IPNet {
+	if n.full {
+		dest := &net.IPNet{IP: append(net.IP{}, ip...), Mask: net.CIDRMask(depth, len(ip)*8)}
+		return append(dests, dest)
+	}
+	for b, c := range n.child {
+		if c == nil {
+			continue
+		}
+		if b == 1 {
+			ip[depth/8] |= 0x80 >> uint(depth%8)
+		}
+		dests = c.collect(ip, depth+1, dests)
+		ip[depth/8] &^= 0x80 >> uint(depth%8)
+	}
+	return dests
+}
+
+// drop the prefixes covered by others and join adjacent ones, ipv4
+// ones come first
+func aggregateRoutes(dests []*net.IPNet) []*net.IPNet {
+	root4, root6 := new(prefixNode), new(prefixNode)
+	for _, dest := range dests {
+		plen, _ := dest.Mask.Size()
+		if ip4 := dest.IP.To4(); ip4 != nil {
+			root4.insert(ip4, plen)
+		} else {
+			root6.insert(dest.IP.To16(), plen)
+		}
+	}
+	root4.merge()
+	root6.merge()
+
+	aggr := root4.collect(make(net.IP, net.IPv4len), 0, nil)
+	return root6.collect(make(net.IP, net.IPv6len), 0, aggr)
+}
+
+// routes from a list via one next hop, only the ones that were
+// actually added are deleted again
+type elRouteSet struct {
+	dests []*net.IPNet
+	gw    net.IP
+	iface string
+}
+
+func (s *elRouteSet) install() {
+	if len(s.dests) == 0 {
+		return
+	}
+	logger.Info("adding %d routes via %v dev %s", len(s.dests), s.gw, s.iface)
+	added, err := rtnl.routeListAdd(s.dests, s.gw, s.iface, ROUTE_LIST_METRIC)
+	if err != nil {
+		logger.Warning("route list: %v", err)
+	}
+	s.dests = added
+}
+
+func (s *elRouteSet) remove() {
+	if len(s.dests) == 0 {
+		return
+	}
+	logger.Info("deleting %d routes via %v dev %s", len(s.dests), s.gw, s.iface)
+	if err := rtnl.routeListDel(s.dests, s.gw, s.iface, ROUTE_LIST_METRIC); err != nil {
+		logger.Warning("route list: %v", err)
+	}
+	s.dests = nil
+}
+
+// split dests by family
+func splitFamilies(dests []*net.IPNet) (v4, v6 []*net.IPNet) {
+	for _, dest := range dests {
+		if dest.IP.To4() != nil {
+			v4 = append(v4, dest)
+		} else {
+			v6 = append(v6, dest)
+		}
+	}
+	return v4, v6
+}
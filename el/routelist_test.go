@@ -0,0 +1,54 @@
+package el
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_RouteList_Aggregate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.txt")
+	list := `# comment
+10.0.0.0/25
+10.0.0.128/25
+10.0.1.0/24   # joins 10.0.0.0/24 into a /23
+10.0.0.64/26
+192.168.1.7
+192.168.1.6
+172.16.5.0/24
+172.16.0.0/12
+
+fd00::/17
+fd00:8000::/17
+`
+	if err := os.WriteFile(file, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dests, err := loadRouteLists([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/23", "172.16.0.0/12", "192.168.1.6/31", "fd00::/16"}
+	if len(dests) != len(want) {
+		t.Fatalf("got %v, want %v", dests, want)
+	}
+	for i, dest := range dests {
+		if dest.String() != want[i] {
+			t.Errorf("got %v, want %v", dests, want)
+			break
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("10.0.0.0/33\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRouteLists([]string{file}); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+
+	all := aggregateRoutes([]*net.IPNet{mustCIDR(t, "0.0.0.0/1"), mustCIDR(t, "128.0.0.0/1")})
+	if len(all) != 1 || all[0].String() != "0.0.0.0/0" {
+		t.Errorf("got %v, want 0.0.0.0/0", all)
+	}
+}
@@ -21,18 +21,20 @@ package el
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/songgao/water"
 	"github.com/songgao/water/waterutil"
 )
 
@@ -50,27 +52,71 @@ type ElServer struct {
 	// config
 	cfg ElServerConfig
 	// interface
-	iface *water.Interface
+	iface tunDevice
+	// all queues of the interface, iface is the first one
+	queues []tunDevice
 	// subnet
 	ipnet *net.IPNet
 	// IP Pool
 	ippool *elIPPool
-	// client peers, key is the mac address, value is a ElPeer record
-	peers map[uint64]*ElPeer
-
-	// channel to put in packets read from udpsocket
-	fromNet chan *udpPacket
-	// channel to put packets to send through udpsocket
-	toNet []chan *udpPacket
-	// channel to put frames read from tun/tap device
-	fromIface chan []byte
-	// channel to put frames to send to tun/tap device
-	toIface chan *ElPacket
+	// IPv6 subnet and pool, nil if the tunnel is IPv4 only
+	ipnet6  *net.IPNet
+	ippool6 *elIPPool6
+	// client peers by session id, the id sits in the upper 32 bits
+	sessionTable map[uint64]*ElPeer
+	// client peers by their tunnel addresses and the subnets behind them
+	routes *elRouteTable
+	// subnets routed to clients, by client name
+	iroutes map[string][]*net.IPNet
+	// tap mode, peers by the mac addresses learned from their frames
+	tap  bool
+	macs map[uint64]*ElPeer
+	// how frames between peers are forwarded
+	c2c int
+	// options pushed to every client in the handshake ack
+	push *elOptions
+	// nil unless the server masquerades
+	nat *elNat
+	// nil without rules to set up
+	fw firewall
+	// fix the mss of syns through the device ourselves
+	clampMSS bool
+
+	// queues to put in packets read from udpsocket, one per
+	// decryption worker
+	fromNet []*elQueue
+	// queues to put packets to send through udpsocket, one per
+	// socket, a packet's channel is the index of its socket
+	toNet []*elQueue
+	// queues to put frames read from tun/tap device, one per device queue
+	fromIface []*elQueue
+	// queues to put frames to send to tun/tap device, one per device queue
+	toIface []*elQueue
 
 	pktHandle map[byte](func(*udpPacket, *ElPacket))
 
-	_lock        sync.RWMutex
-	_chanBufSize int
+	_lock sync.RWMutex
+}
+
+const (
+	C2C_KERNEL int = iota // through the device and the kernel's routing
+	C2C_DIRECT            // straight from peer to peer by the server
+	C2C_DENY              // not at all, clients are isolated
+)
+
+var invalidClientToClient = errors.New("Invalid client-to-client mode")
+
+func parseClientToClient(s string) (int, error) {
+	switch s {
+	case "", "kernel":
+		return C2C_KERNEL, nil
+	case "direct":
+		return C2C_DIRECT, nil
+	case "deny":
+		return C2C_DENY, nil
+	default:
+		return 0, invalidClientToClient
+	}
 }
 
 func NewServer(cfg ElServerConfig) error {
@@ -86,31 +132,153 @@ func NewServer(cfg ElServerConfig) error {
 		MTU = cfg.MTU
 	}
 
+	policy, err := parseDropPolicy(cfg.Drop_policy)
+	if err != nil {
+		return err
+	}
+	tap, err := parseDevType(cfg.Dev_type)
+	if err != nil {
+		return err
+	}
+	c2c, err := parseClientToClient(cfg.Client_to_client)
+	if err != nil {
+		return err
+	}
+	topology, err := parseTopology(cfg.Topology)
+	if err != nil {
+		return err
+	}
+	mssClamp, err := parseMSSClamp(cfg.Mss_clamp)
+	if err != nil {
+		return err
+	}
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
 	elServer := new(ElServer)
-	elServer._chanBufSize = 2048
-	elServer.fromNet = make(chan *udpPacket, elServer._chanBufSize)
-	elServer.fromIface = make(chan []byte, elServer._chanBufSize)
-	elServer.toIface = make(chan *ElPacket, elServer._chanBufSize)
-	elServer.peers = make(map[uint64]*ElPeer)
+	elServer.fromNet = make([]*elQueue, workers)
+	for idx := range elServer.fromNet {
+		name := fmt.Sprintf("fromNet[%d]", idx)
+		elServer.fromNet[idx] = newElQueue(name, cfg.QueueLen, policy)
+	}
+	elServer.sessionTable = make(map[uint64]*ElPeer)
+	elServer.routes = newElRouteTable()
+	elServer.iroutes, err = parseIroutes(cfg.Iroutes)
+	if err != nil {
+		return err
+	}
+	elServer.tap = tap
+	elServer.c2c = c2c
+	elServer.clampMSS = cfg.FixMSS && mssClamp == MSS_CLAMP_PROCESS
+	elServer.macs = make(map[uint64]*ElPeer)
 	elServer.cfg = cfg
-	elServer.toNet = make([]chan *udpPacket, (cfg.HopEnd - cfg.HopStart + 1))
-	elServer.ippool = new(elIPPool)
+	sockets := cfg.Sockets
+	if sockets <= 0 {
+		sockets = 1
+	}
+	hosts := listenHosts(cfg.ListenAddr)
+	elServer.toNet = make([]*elQueue, len(hosts)*(cfg.HopEnd-cfg.HopStart+1)*sockets)
+	for idx := range elServer.toNet {
+		host := hosts[idx%len(hosts)]
+		n := idx / len(hosts)
+		name := fmt.Sprintf("toNet[%s:%d/%d]", host, cfg.HopStart+n/sockets, n%sockets)
+		elServer.toNet[idx] = newElQueue(name, cfg.QueueLen, policy)
+	}
 
-	iface, err := newTun("")
+	queues, err := newTunQueues("", tap, cfg.Queues, cfg.Offload)
 	if err != nil {
 		return err
 	}
+	iface := queues[0]
 	elServer.iface = iface
+	elServer.queues = queues
+	elServer.fromIface = make([]*elQueue, len(queues))
+	elServer.toIface = make([]*elQueue, len(queues))
+	for idx := range queues {
+		elServer.fromIface[idx] = newElQueue(fmt.Sprintf("fromIface[%d]", idx), cfg.QueueLen, policy)
+		elServer.toIface[idx] = newElQueue(fmt.Sprintf("toIface[%d]", idx), cfg.QueueLen, policy)
+	}
 	ip, subnet, err := net.ParseCIDR(cfg.Addr)
-	err = setTunIP(iface, ip, subnet)
+	switch {
+	case tap && cfg.Bridge != "":
+		// the address belongs to the bridge then
+		err = setBridge(iface, cfg.Bridge)
+	case tap:
+		err = setSubnetIP(iface, ip, subnet)
+	case topology == TOPOLOGY_SUBNET:
+		err = setSubnetIP(iface, ip, subnet)
+	default:
+		err = setTunIP(iface, ip, subnet)
+	}
 	if err != nil {
 		return err
 	}
 	elServer.ipnet = &net.IPNet{ip, subnet.Mask}
-	elServer.ippool.subnet = subnet
+	elServer.ippool, err = newElIPPool(subnet, ip, cfg.Pool_range, cfg.Reservations)
+	if err != nil {
+		return err
+	}
+	if cfg.Lease_file != "" {
+		leaseTime := time.Duration(cfg.Lease_time) * time.Second
+		if err = elServer.ippool.loadLeases(cfg.Lease_file, leaseTime); err != nil {
+			return err
+		}
+	}
+
+	elServer.push, err = pushOptions(cfg, tap, topology, ip)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Addr6 != "" {
+		ip6, subnet6, err := net.ParseCIDR(cfg.Addr6)
+		if err != nil {
+			return err
+		}
+		if cfg.Bridge == "" {
+			if err = setTunIP6(iface, ip6, subnet6); err != nil {
+				return err
+			}
+		}
+		elServer.ipnet6 = &net.IPNet{IP: ip6, Mask: subnet6.Mask}
+		elServer.ippool6 = newElIPPool6(subnet6, ip6)
+	}
 
-	if cfg.FixMSS {
-		fixMSS(iface.Name(), true)
+	// subnets behind clients are reached through the device,
+	// a tap device would need a next hop for each
+	if tap && len(elServer.iroutes) > 0 {
+		logger.Warning("iroutes need a tun device, ignored")
+		elServer.iroutes = nil
+	}
+	for name, subnets := range elServer.iroutes {
+		for _, subnet := range subnets {
+			if err = addDevRoute(subnet.String(), iface.Name()); err != nil {
+				logger.Warning("route %s to client %s: %v", subnet, name, err)
+			}
+		}
+	}
+
+	elServer.nat, err = newElNat(cfg)
+	if err != nil {
+		return err
+	}
+	// the rules first, forwarding is only turned on once they're in
+	elServer.fw, err = setupFirewall(cfg.Firewall, "server", serverFirewallRules(cfg, iface.Name(), elServer.nat))
+	if err != nil {
+		return err
+	}
+	if elServer.nat != nil {
+		if err = elServer.nat.setup(); err != nil {
+			// put back the sysctls it got to and drop the rules
+			elServer.nat.cleanUp()
+			if elServer.fw != nil {
+				elServer.fw.flush()
+			}
+			return err
+		}
 	}
 
 	// traffic morpher
@@ -124,8 +292,16 @@ func NewServer(cfg ElServerConfig) error {
 		logger.Info("No Traffic Morphing")
 	}
 
-	// forward device frames to socket and socket packets to device
-	go elServer.forwardFrames()
+	// forward device frames to peers, each peer encrypts its own frames
+	for _, q := range elServer.fromIface {
+		go elServer.forwardFrames(q)
+	}
+	// decrypt socket packets in parallel
+	elServer.initHandlers()
+	for _, q := range elServer.fromNet {
+		go elServer.decryptWorker(q)
+	}
+	logger.Info("%d decryption workers", workers)
 
 	// go func() {
 	//     defer hopServer.cleanUp()
@@ -133,13 +309,23 @@ func NewServer(cfg ElServerConfig) error {
 	// }()
 	go elServer.cleanUp()
 
-	// serve for multiple ports
+	// serve for multiple ports, with several sockets sharing
+	// each port if asked to
+	if sockets > 1 {
+		logger.Info("%d SO_REUSEPORT sockets per port", sockets)
+	}
 	for idx, port := 0, cfg.HopStart; port <= cfg.HopEnd; port++ {
-		go elServer.listenAndServe(cfg.ListenAddr, fmt.Sprintf("%d", port), idx)
-		idx++
+		for i := 0; i < sockets; i++ {
+			for _, host := range hosts {
+				go elServer.listenAndServe(host, fmt.Sprintf("%d", port), idx)
+				idx++
+			}
+		}
 	}
 
 	go elServer.peerTimeoutWatcher()
+	go elServer.queueWatcher()
+	go elServer.leaseDumper()
 	logger.Debug("Recieving iface frames")
 
 	// Post Up
@@ -155,88 +341,239 @@ func NewServer(cfg ElServerConfig) error {
 		cmd.Run()
 	}
 
-	// handle interface
+	// handle interface, every device queue is read and written
+	// on its own
+	for idx := range queues {
+		go elServer.writeIface(idx)
+	}
+	for idx := 1; idx < len(queues); idx++ {
+		go elServer.readIface(idx)
+	}
+	return elServer.readIface(0)
+}
 
-	go func() {
-		for {
-			hp := <-elServer.toIface
-			// logger.Debug("New Net packet to device")
-			_, err := iface.Write(hp.payload)
-			// logger.Debug("n: %d, len: %d", n, len(hp.payload))
-			if err != nil {
-				logger.Error(err.Error())
-				return
-			}
+func (srv *ElServer) readIface(idx int) error {
+	iface := srv.queues[idx]
+	for {
+		// read right behind the room left for the header
+		buf := getBuffer()
+		n, err := iface.Read(buf[HOP_HDR_LEN:])
+		if err != nil {
+			logger.Error(err.Error())
+			return err
 		}
-	}()
 
-	buf := make([]byte, IFACE_BUFSIZE)
+		hpbuf := buf[:n+HOP_HDR_LEN]
+		// owned by the destination so that fair dropping
+		// charges the peer the frames are queued for
+		frame := hpbuf[HOP_HDR_LEN:]
+		if srv.clampMSS {
+			clampMSS(ipFrame(frame, srv.tap))
+		}
+		if srv.tap {
+			srv.fromIface[idx].Push(mac2uint64(frame[:6]), hpbuf)
+		} else {
+			srv.fromIface[idx].Push(destHash(frame), hpbuf)
+		}
+	}
+}
+
+func (srv *ElServer) writeIface(idx int) {
+	iface := srv.queues[idx]
+	q := srv.toIface[idx]
+	hps := make([]*ElPacket, 0, IFACE_BATCH_SIZE)
+	frames := make([][]byte, 0, IFACE_BATCH_SIZE)
 	for {
-		n, err := iface.Read(buf)
+		// block for the first packet, then take whatever
+		// else is queued up to a batch
+		hps = append(hps[:0], q.Pop().(*ElPacket))
+		for len(hps) < IFACE_BATCH_SIZE {
+			hp, ok := q.TryPop()
+			if !ok {
+				break
+			}
+			hps = append(hps, hp.(*ElPacket))
+		}
+		frames = frames[:0]
+		for _, hp := range hps {
+			if srv.clampMSS {
+				clampMSS(ipFrame(hp.payload, srv.tap))
+			}
+			frames = append(frames, hp.payload)
+		}
+		// logger.Debug("New Net packets to device")
+		err := writeFrames(iface, frames)
+		for _, hp := range hps {
+			hp.release()
+		}
 		if err != nil {
-			return err
+			logger.Error(err.Error())
+			return
 		}
+	}
+}
+
+// handle a frame one peer sends to another without the kernel,
+// returns false if it still has to go to the device
+func (srv *ElServer) betweenPeers(owner uint64, hp *ElPacket) bool {
+	frame := hp.payload
+	var hpeer *ElPeer
+	if srv.tap {
+		if len(frame) < ETH_HDR_LEN {
+			return false
+		}
+		// the device can't send a frame back to every peer, so
+		// broadcast and multicast are flooded here whatever the
+		// c2c mode and reach the device as well
+		if frame[0]&0x01 != 0 {
+			if srv.c2c != C2C_DENY {
+				srv.flood(owner, frame)
+			}
+			return false
+		}
+		hpeer, _ = srv.getMacPeer(mac2uint64(frame[:6]))
+	} else {
+		if srv.c2c == C2C_KERNEL {
+			return false
+		}
+		hpeer, _ = srv.ipPeer(frame)
+	}
+	if hpeer == nil || hpeer.id == owner {
+		return false
+	}
+
+	if srv.c2c != C2C_DENY {
+		pack := getBufferSize(HOP_HDR_LEN + len(frame))
+		copy(pack[HOP_HDR_LEN:], frame)
+		hpeer.fromIface.Push(hpeer.id, pack)
+	}
+	hp.release()
+	return true
+}
+
+// queue a packet from a peer to the device, packets of the same
+// flow always go through the same device queue
+func (srv *ElServer) toDevice(owner uint64, hp *ElPacket) {
+	if srv.betweenPeers(owner, hp) {
+		return
+	}
+	frame := hp.payload
+	if srv.tap {
+		frame = ethPayload(frame)
+	}
+	idx := int(flowHash(frame) % uint32(len(srv.toIface)))
+	srv.toIface[idx].Push(owner, hp)
+}
 
-		hpbuf := make([]byte, n+HOP_HDR_LEN)
-		copy(hpbuf[HOP_HDR_LEN:], buf[:n])
-		elServer.fromIface <- hpbuf
+// the options every client gets
+func pushOptions(cfg ElServerConfig, tap bool, topology int, ip net.IP) (*elOptions, error) {
+	o := newElOptions()
+	o.mtu = MTU
+	o.topology = topology
+	o.heartbeat = cfg.Push_heartbeat
+	// there is no peer address to route via, tap clients
+	// need a next hop though
+	if tap || topology == TOPOLOGY_SUBNET {
+		o.gateway = ip.To4()
+	}
+	if cfg.Push_redirect_gateway != "" {
+		redirect, err := strconv.ParseBool(cfg.Push_redirect_gateway)
+		if err != nil {
+			return nil, err
+		}
+		o.redirect = &redirect
+	}
+	for _, s := range cfg.Push_route {
+		_, route, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		o.routes = append(o.routes, route)
+	}
+	for _, s := range cfg.Push_dns {
+		dns := net.ParseIP(s)
+		if dns == nil {
+			return nil, fmt.Errorf("invalid dns server %s", s)
+		}
+		o.dns = append(o.dns, dns)
 	}
+	o.domains = cfg.Push_domain
+	return o, nil
+}
 
+// addresses to listen on, both families unless one is configured
+func listenHosts(addr string) []string {
+	if addr == "" {
+		return []string{"0.0.0.0", "::"}
+	}
+	return []string{addr}
 }
 
 func (srv *ElServer) listenAndServe(addr string, port string, idx int) {
-	port = addr + ":" + port
-	udpAddr, err := net.ResolveUDPAddr("udp", port)
+	network := "udp4"
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		network = "udp6"
+	}
+	port = net.JoinHostPort(addr, port)
+	udpAddr, err := net.ResolveUDPAddr(network, port)
 	if err != nil {
 		logger.Error("Invalid port: %s", port)
 		return
 	}
-	udpConn, err := net.ListenUDP("udp", udpAddr)
+	// udp6 sockets are v6 only, so both families can share a port
+	udpConn, err := listenUDP(network, udpAddr, srv.cfg.Sockets > 1)
 	if err != nil {
 		logger.Error("Failed to listen udp port %s: %s", port, err.Error())
 		return
 	}
 
-	toNet := make(chan *udpPacket, srv._chanBufSize)
-
-	go func() {
-		defer srv._lock.Unlock()
-		srv._lock.Lock()
-		srv.toNet[idx] = toNet
-		// logger.Debug("Listening on port %s", port)
-	}()
+	toNet := srv.toNet[idx]
+	bconn := newBatchConn(udpConn)
 
 	go func() {
+		packets := make([]*udpPacket, 0, UDP_BATCH_SIZE)
 		for {
-			packet := <-toNet
+			// block for the first packet, then take whatever
+			// else is queued up to a batch
+			packets = append(packets[:0], toNet.Pop().(*udpPacket))
+			for len(packets) < UDP_BATCH_SIZE {
+				p, ok := toNet.TryPop()
+				if !ok {
+					break
+				}
+				packets = append(packets, p.(*udpPacket))
+			}
 			// logger.Debug("index: %d, port: %s", idx, port)
-			// logger.Debug("client addr: %v", packet.addr)
-			udpConn.WriteTo(packet.data, packet.addr)
+			if _, err := bconn.writeBatch(packets); err != nil {
+				logger.Debug("Failed to send udp packets: %s", err.Error())
+			}
+			for _, packet := range packets {
+				putBuffer(packet.data)
+			}
 		}
 	}()
 
+	packets := make([]*udpPacket, UDP_BATCH_SIZE)
 	for {
-		var plen int
-		packet := new(udpPacket)
-		packet.channel = idx
-		buf := make([]byte, IFACE_BUFSIZE)
+		for i := range packets {
+			packets[i] = &udpPacket{channel: idx}
+		}
 		// logger.Debug("Recieving packet %s", port)
-		plen, packet.addr, err = udpConn.ReadFromUDP(buf)
-		// logger.Debug("New UDP Packet from: %v", packet.addr)
-
-		packet.data = buf[:plen]
+		n, err := bconn.readBatch(packets)
 		if err != nil {
 			logger.Error(err.Error())
 			return
 		}
 
-		srv.fromNet <- packet
+		for _, packet := range packets[:n] {
+			// logger.Debug("New UDP Packet from: %v", packet.addr)
+			srv.dispatch(packet)
+		}
 	}
 
 }
 
-func (srv *ElServer) forwardFrames() {
-
+func (srv *ElServer) initHandlers() {
 	// packet map
 	srv.pktHandle = map[byte](func(*udpPacket, *ElPacket)){
 		HOP_FLG_PSH:               srv.handleKnock,
@@ -247,27 +584,57 @@ func (srv *ElServer) forwardFrames() {
 		HOP_FLG_DAT | HOP_FLG_MFR: srv.handleDataPacket,
 		HOP_FLG_FIN:               srv.handleFinish,
 	}
+}
 
+// route device frames to their peer, encryption is left
+// to the peer's own goroutine
+func (srv *ElServer) forwardFrames(q *elQueue) {
 	for {
-		select {
-		case pack := <-srv.fromIface:
-			// logger.Debug("New iface Frame")
-			// first byte is left for opcode
-			frame := pack[HOP_HDR_LEN:]
-			dest := waterutil.IPv4Destination(frame).To4()
-			mkey := ip4_uint64(dest)
-
-			// logger.Debug("ip dest: %v", dest)
-			if hpeer, found := srv.peers[mkey]; found {
-				srv.bufferToClient(hpeer, pack)
-			} else {
-				logger.Warning("client peer with key %d not found", mkey)
-			}
+		pack := q.Pop().([]byte)
+		// logger.Debug("New iface Frame")
+		// first byte is left for opcode
+		if srv.tap {
+			srv.switchFrame(pack)
+			continue
+		}
+		hpeer, dest := srv.ipPeer(pack[HOP_HDR_LEN:])
 
-		case packet := <-srv.fromNet:
-			srv.handlePacket(packet)
+		// logger.Debug("ip dest: %v", dest)
+		if hpeer != nil {
+			hpeer.fromIface.Push(hpeer.id, pack)
+		} else {
+			logger.Warning("client peer with address %v not found", dest)
+			putBuffer(pack)
 		}
+	}
+}
+
+// the peer an ip packet is addressed to, nil if there is none
+func (srv *ElServer) ipPeer(frame []byte) (hpeer *ElPeer, dest net.IP) {
+	switch {
+	case len(frame) >= 20 && frame[0]>>4 == 4:
+		dest = waterutil.IPv4Destination(frame).To4()
+		hpeer, _ = srv.routes.lookup(dest)
+	case len(frame) >= 40 && frame[0]>>4 == 6:
+		dest = ipv6Destination(frame)
+		hpeer, _ = srv.routes.lookup(dest)
+	}
+	return hpeer, dest
+}
+
+// packets from the same source address always go to the same
+// worker, so a peer's packets are decrypted in order
+func (srv *ElServer) dispatch(packet *udpPacket) {
+	h := fnv32(FNV32_OFFSET, packet.addr.IP)
+	idx := int(h % uint32(len(srv.fromNet)))
+	srv.fromNet[idx].Push(uint64(h), packet)
+}
 
+func (srv *ElServer) decryptWorker(q *elQueue) {
+	for {
+		packet := q.Pop().(*udpPacket)
+		srv.handlePacket(packet)
+		putBuffer(packet.data)
 	}
 }
 
@@ -286,6 +653,10 @@ func (srv *ElServer) handlePacket(packet *udpPacket) {
 		} else {
 			logger.Error("Unkown flag: %x", hPack.Flag)
 		}
+		// data packets are released once written to the device
+		if hPack.Flag&^HOP_FLG_MFR != HOP_FLG_DAT {
+			hPack.release()
+		}
 	} else {
 		logger.Error(err.Error())
 	}
@@ -300,7 +671,7 @@ func (srv *ElServer) toClient(peer *ElPeer, flag byte, payload []byte, noise boo
 	if addr, idx, ok := peer.addr(); ok {
 		logger.Debug("peer: %v", addr)
 		upacket := &udpPacket{addr, hp.Pack(), idx}
-		srv.toNet[idx] <- upacket
+		srv.toNet[idx].Push(peer.id, upacket)
 	} else {
 		logger.Debug("peer not found")
 	}
@@ -315,7 +686,7 @@ func (srv *ElServer) bufferToClient(peer *ElPeer, buf []byte) {
 
 	if addr, idx, ok := peer.addr(); ok {
 		upacket := &udpPacket{addr, hp.Pack(), idx}
-		srv.toNet[idx] <- upacket
+		srv.toNet[idx].Push(peer.id, upacket)
 	}
 
 	/*
@@ -340,11 +711,8 @@ func (srv *ElServer) handleKnock(u *udpPacket, hp *ElPacket) {
 	logger.Debug("port knock from client %v, sid: %d", u.addr, sid)
 	sid = (sid << 32) & uint64(0xFFFFFFFF00000000)
 
-	hpeer, ok := srv.peers[sid]
-	if !ok {
-		hpeer = newElPeer(sid, srv, u.addr, u.channel)
-		srv.peers[sid] = hpeer
-	} else {
+	hpeer, created := srv.sessionPeer(sid, u)
+	if !created {
 		hpeer.insertAddr(u.addr, u.channel)
 		if hpeer.state == HOP_STAT_WORKING {
 			srv.toClient(hpeer, HOP_FLG_PSH|HOP_FLG_ACK, []byte{0}, true)
@@ -358,7 +726,7 @@ func (srv *ElServer) handleHeartbeatAck(u *udpPacket, hp *ElPacket) {
 	sid := uint64(binary.BigEndian.Uint32(hp.payload[:4]))
 	sid = (sid << 32) & uint64(0xFFFFFFFF00000000)
 
-	hpeer, ok := srv.peers[sid]
+	hpeer, ok := srv.getPeer(sid)
 	if !ok {
 		return
 	}
@@ -371,30 +739,64 @@ func (srv *ElServer) handleHandshake(u *udpPacket, hp *ElPacket) {
 	sid = (sid << 32) & uint64(0xFFFFFFFF00000000)
 	logger.Debug("handshake from client %v, sid: %d", u.addr, sid)
 
-	hpeer, ok := srv.peers[sid]
-	if !ok {
-		hpeer = newElPeer(sid, srv, u.addr, u.channel)
-		srv.peers[sid] = hpeer
-	} else {
+	hpeer, created := srv.sessionPeer(sid, u)
+	if !created {
 		hpeer.insertAddr(u.addr, u.channel)
+		// a retried handshake gets its addresses and routes anew
+		if hpeer.ip != nil {
+			srv.releaseAddrs(hpeer)
+			hpeer.ip, hpeer.ip6 = nil, nil
+		}
+	}
+
+	// clients are known by name if they send one, by their
+	// address otherwise
+	if len(hp.payload) > 4 {
+		hpeer.name = string(hp.payload[4:])
+	}
+	key := hpeer.name
+	if key == "" {
+		key = u.addr.IP.String()
 	}
 
-	cltIP, err := srv.ippool.next()
+	cltIP, err := srv.ippool.next(key)
 	if err != nil {
 		msg := fmt.Sprintf("%s", err.Error())
 		srv.toClient(hpeer, HOP_FLG_HSH|HOP_FLG_FIN, []byte(msg), true)
-		delete(srv.peers, sid)
+		srv.unsetPeer(sid)
+		hpeer.stop()
 	} else {
 		hpeer.ip = cltIP.IP.To4()
 		mask, _ := cltIP.Mask.Size()
-		buf := bytes.NewBuffer(make([]byte, 0, 8))
+		buf := bytes.NewBuffer(make([]byte, 0, 24))
 		buf.WriteByte(HOP_PROTO_VERSION)
 		buf.Write([]byte(hpeer.ip))
 		buf.WriteByte(byte(mask))
-		key := ip4_uint64(hpeer.ip)
+		logger.Debug("assign address %s", cltIP)
+		srv.routes.add(hostRoute(hpeer.ip), hpeer)
+
+		// subnets behind the client, if it told us its name
+		if hpeer.name != "" {
+			for _, subnet := range srv.iroutes[hpeer.name] {
+				logger.Info("route %s to client %s", subnet, hpeer.name)
+				srv.routes.add(subnet, hpeer)
+			}
+		}
 
-		logger.Debug("assign address %s, route key %d", cltIP, key)
-		srv.peers[key] = hpeer
+		// everything else goes in options behind the IPv4
+		// address, older clients don't read that far
+		opts := *srv.push
+		if srv.ippool6 != nil {
+			if cltIP6, err := srv.ippool6.next(); err == nil {
+				hpeer.ip6 = cltIP6.IP
+				opts.ip6 = cltIP6
+				logger.Debug("assign address %s", cltIP6)
+				srv.routes.add(hostRoute(hpeer.ip6), hpeer)
+			} else {
+				logger.Warning("no IPv6 address for client %d: %v", sid, err)
+			}
+		}
+		opts.encode(buf)
 		atomic.StoreInt32(&hpeer.state, HOP_STAT_HANDSHAKE)
 		srv.toClient(hpeer, HOP_FLG_HSH|HOP_FLG_ACK, buf.Bytes(), true)
 		hpeer.hsDone = make(chan struct{})
@@ -414,9 +816,9 @@ func (srv *ElServer) handleHandshake(u *udpPacket, hp *ElPacket) {
 			srv.toClient(hpeer, HOP_FLG_HSH|HOP_FLG_FIN, []byte{}, true)
 			srv.toClient(hpeer, HOP_FLG_HSH|HOP_FLG_FIN, []byte{}, true)
 
-			srv.ippool.relase(hpeer.ip)
-			delete(srv.peers, sid)
-			delete(srv.peers, key)
+			srv.releaseAddrs(hpeer)
+			srv.unsetPeer(sid)
+			hpeer.stop()
 
 		}()
 	}
@@ -426,7 +828,7 @@ func (srv *ElServer) handleHandshake(u *udpPacket, hp *ElPacket) {
 func (srv *ElServer) handleHandshakeAck(u *udpPacket, hp *ElPacket) {
 	sid := uint64(binary.BigEndian.Uint32(hp.payload[:4]))
 	sid = (sid << 32) & uint64(0xFFFFFFFF00000000)
-	hpeer, ok := srv.peers[sid]
+	hpeer, ok := srv.getPeer(sid)
 	if !ok {
 		return
 	}
@@ -444,9 +846,12 @@ func (srv *ElServer) handleDataPacket(u *udpPacket, hp *ElPacket) {
 	sid := uint64(hp.Sid)
 	sid = (sid << 32) & uint64(0xFFFFFFFF00000000)
 
-	if hpeer, ok := srv.peers[sid]; ok && hpeer.state == HOP_STAT_WORKING {
+	if hpeer, ok := srv.getPeer(sid); ok && hpeer.state == HOP_STAT_WORKING {
 		// logger.Debug("n peer addrs: %v", len(peer._addrs_lst))
 		// peer.insertAddr(u.addr, u.channel)
+		if srv.tap {
+			srv.learnMac(hpeer, hp.payload)
+		}
 		hpeer.recvBuffer.Push(hp)
 		hpeer.lastSeenTime = time.Now()
 	}
@@ -461,7 +866,7 @@ func (srv *ElServer) handleFinish(u *udpPacket, hp *ElPacket) {
 }
 
 func (srv *ElServer) kickOutPeer(sid uint64) {
-	hpeer, ok := srv.peers[sid]
+	hpeer, ok := srv.getPeer(sid)
 	if !ok {
 		return
 	}
@@ -472,21 +877,126 @@ func (srv *ElServer) kickOutPeer(sid uint64) {
 }
 
 func (srv *ElServer) deletePeer(sid uint64) {
-	hpeer, ok := srv.peers[sid]
+	hpeer, ok := srv.getPeer(sid)
 	if !ok {
 		return
 	}
 
-	key := ip4_uint64(hpeer.ip)
-	srv.ippool.relase(hpeer.ip)
-
-	delete(srv.peers, sid)
-	delete(srv.peers, key)
+	srv.releaseAddrs(hpeer)
+	srv.unsetPeer(sid)
+	hpeer.stop()
 
 	srv.toClient(hpeer, HOP_FLG_FIN|HOP_FLG_ACK, []byte{}, false)
 	srv.toClient(hpeer, HOP_FLG_FIN|HOP_FLG_ACK, []byte{}, false)
 }
 
+func (srv *ElServer) getPeer(sid uint64) (*ElPeer, bool) {
+	defer srv._lock.RUnlock()
+	srv._lock.RLock()
+	hpeer, ok := srv.sessionTable[sid]
+	return hpeer, ok
+}
+
+// give the peer's tunnel addresses back to the pools and
+// drop every route to it
+func (srv *ElServer) releaseAddrs(hpeer *ElPeer) {
+	srv.ippool.relase(hpeer.ip)
+	if hpeer.ip6 != nil {
+		srv.ippool6.relase(hpeer.ip6)
+	}
+	srv.routes.removePeer(hpeer)
+
+	defer srv._lock.Unlock()
+	srv._lock.Lock()
+	for mac, p := range srv.macs {
+		if p == hpeer {
+			delete(srv.macs, mac)
+		}
+	}
+}
+
+// remember which peer a source mac address is behind
+func (srv *ElServer) learnMac(hpeer *ElPeer, frame []byte) {
+	if len(frame) < ETH_HDR_LEN || frame[6]&0x01 != 0 {
+		return
+	}
+	mac := mac2uint64(frame[6:12])
+	if p, found := srv.getMacPeer(mac); found && p == hpeer {
+		return
+	}
+	logger.Debug("learned %v behind client %d", net.HardwareAddr(frame[6:12]), hpeer.id>>32)
+
+	defer srv._lock.Unlock()
+	srv._lock.Lock()
+	srv.macs[mac] = hpeer
+}
+
+func (srv *ElServer) getMacPeer(mac uint64) (*ElPeer, bool) {
+	defer srv._lock.RUnlock()
+	srv._lock.RLock()
+	hpeer, ok := srv.macs[mac]
+	return hpeer, ok
+}
+
+// send an ethernet frame to the peer its destination was learned
+// from, broadcast, multicast and unknown unicast go to every peer
+func (srv *ElServer) switchFrame(pack []byte) {
+	frame := pack[HOP_HDR_LEN:]
+	if len(frame) < ETH_HDR_LEN {
+		putBuffer(pack)
+		return
+	}
+	if frame[0]&0x01 == 0 {
+		if hpeer, found := srv.getMacPeer(mac2uint64(frame[:6])); found {
+			hpeer.fromIface.Push(hpeer.id, pack)
+			return
+		}
+	}
+	srv.flood(0, frame)
+	putBuffer(pack)
+}
+
+// send a copy of an ethernet frame to every peer but one
+func (srv *ElServer) flood(except uint64, frame []byte) {
+	for _, hpeer := range srv.sessions() {
+		if hpeer.id == except || atomic.LoadInt32(&hpeer.state) != HOP_STAT_WORKING {
+			continue
+		}
+		pack := getBufferSize(HOP_HDR_LEN + len(frame))
+		copy(pack[HOP_HDR_LEN:], frame)
+		hpeer.fromIface.Push(hpeer.id, pack)
+	}
+}
+
+func (srv *ElServer) unsetPeer(sid uint64) {
+	defer srv._lock.Unlock()
+	srv._lock.Lock()
+	delete(srv.sessionTable, sid)
+}
+
+// return the peer of session sid, creating it if it's new
+func (srv *ElServer) sessionPeer(sid uint64, u *udpPacket) (*ElPeer, bool) {
+	defer srv._lock.Unlock()
+	srv._lock.Lock()
+	if hpeer, ok := srv.sessionTable[sid]; ok {
+		return hpeer, false
+	}
+	hpeer := newElPeer(sid, srv, u.addr, u.channel)
+	srv.sessionTable[sid] = hpeer
+	return hpeer, true
+}
+
+// snapshot of the session table
+func (srv *ElServer) sessions() map[uint64]*ElPeer {
+	defer srv._lock.RUnlock()
+	srv._lock.RLock()
+	sessions := make(map[uint64]*ElPeer, len(srv.sessionTable))
+	for sid, hpeer := range srv.sessionTable {
+		sessions[sid] = hpeer
+	}
+	return sessions
+}
+
 func (srv *ElServer) cleanUp() {
 	// Pre Down
 	if srv.cfg.Down != "" {
@@ -504,16 +1014,34 @@ func (srv *ElServer) cleanUp() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	<-c
-	for _, hpeer := range srv.peers {
+	for _, hpeer := range srv.sessions() {
 		srv.toClient(hpeer, HOP_FLG_FIN|HOP_FLG_ACK, []byte{}, false)
 		srv.toClient(hpeer, HOP_FLG_FIN|HOP_FLG_ACK, []byte{}, false)
 		srv.toClient(hpeer, HOP_FLG_FIN, []byte{}, false)
 		srv.toClient(hpeer, HOP_FLG_FIN, []byte{}, false)
 	}
-	clearMSS(srv.iface.Name(), true)
+	if srv.fw != nil {
+		if err := srv.fw.flush(); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if srv.nat != nil {
+		srv.nat.cleanUp()
+	}
+	srv.ippool.flushLeases()
+	rtnl.rollback()
 	os.Exit(0)
 }
 
+// log the lease table whenever the server gets a SIGUSR1
+func (srv *ElServer) leaseDumper() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for range c {
+		srv.ippool.dumpLeases()
+	}
+}
+
 func (srv *ElServer) peerTimeoutWatcher() {
 	timeout := time.Second * time.Duration(srv.cfg.PeerTimeout)
 	interval := time.Second * time.Duration(srv.cfg.PeerTimeout/2)
@@ -523,20 +1051,14 @@ func (srv *ElServer) peerTimeoutWatcher() {
 			return
 		}
 		time.Sleep(interval)
-		for sid, hpeer := range srv.peers {
+		for sid, hpeer := range srv.sessions() {
 			// Heartbeat
-			if sid < 0x01<<32 {
-				continue
-			}
 			logger.Debug("IP: %v, sid: %v", hpeer.ip, sid)
 			srv.toClient(hpeer, HOP_FLG_PSH, []byte{}, false)
 		}
 		// count := 0
 		time.Sleep(interval)
-		for sid, hpeer := range srv.peers {
-			if sid < 0x01<<32 {
-				continue
-			}
+		for sid, hpeer := range srv.sessions() {
 			logger.Debug("watch: %v", hpeer.lastSeenTime)
 			// if sid>>32 > 0 {
 			// 	count++
@@ -551,3 +1073,32 @@ func (srv *ElServer) peerTimeoutWatcher() {
 		// logger.Info("Ulinks:%d", count)
 	}
 }
+
+// log packet drops, if any, of every queue
+func (srv *ElServer) queueWatcher() {
+	queues := append([]*elQueue{}, srv.fromIface...)
+	queues = append(queues, srv.toIface...)
+	queues = append(queues, srv.fromNet...)
+	queues = append(queues, srv.toNet...)
+	last := make(map[*elQueue]uint64)
+	var lastPeers uint64
+
+	for {
+		time.Sleep(30 * time.Second)
+		for _, q := range queues {
+			if d := q.Dropped(); d != last[q] {
+				logger.Warning("queue overflow: %v", q)
+				last[q] = d
+			}
+		}
+
+		var peerDrops uint64
+		for _, hpeer := range srv.sessions() {
+			peerDrops += hpeer.recvBuffer.Dropped() + hpeer.fromIface.Dropped()
+		}
+		if peerDrops > lastPeers {
+			logger.Warning("peer receive buffers dropped %d packets", peerDrops-lastPeers)
+		}
+		lastPeers = peerDrops
+	}
+}
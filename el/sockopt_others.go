@@ -0,0 +1,42 @@
+//go:build !linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// udp socket options
+
+package el
+
+import (
+	"errors"
+	"net"
+)
+
+func listenUDP(network string, laddr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if reusePort {
+		return nil, errors.New("SO_REUSEPORT sockets are only supported on linux")
+	}
+	return net.ListenUDP(network, laddr)
+}
+
+func dialUDP(raddr *net.UDPAddr, mark int) (*net.UDPConn, error) {
+	if mark != 0 {
+		return nil, errors.New("SO_MARK is only supported on linux")
+	}
+	return net.DialUDP("udp", nil, raddr)
+}
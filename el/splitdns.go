@@ -0,0 +1,500 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// split tunnel by domain, a local dns forwarder routes the addresses
+// names resolve to
+
+package el
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// routes live at least this long, connections outlive short ttls
+	SPLIT_DNS_MIN_TTL = 60 * time.Second
+	SPLIT_DNS_TIMEOUT = 5 * time.Second
+	SPLIT_DNS_MAX_LEN = 65535
+)
+
+type dnsRoute struct {
+	dest   *net.IPNet
+	tunnel bool
+	expire time.Time
+}
+
+type elSplitDNS struct {
+	listen string
+	// domain suffix to true to route through the tunnel, false around it
+	domains map[string]bool
+	// upstream resolvers of the tunnel and of the original network
+	tunnelDNS string
+	localDNS  string
+	// names matching neither list
+	defaultTunnel bool
+	// tunnel device and next hop
+	iface string
+	peer  net.IP
+
+	routes map[string]*dnsRoute
+	_lock  sync.Mutex
+}
+
+// read domain list files, one domain per line and # comments, returns
+// nil if there are none
+func newElSplitDNS(cfg ElClientConfig) (*elSplitDNS, error) {
+	if len(cfg.Include_domains) == 0 && len(cfg.Bypass_domains) == 0 {
+		return nil, nil
+	}
+	s := new(elSplitDNS)
+	s.listen = cfg.Split_dns_listen
+	if s.listen == "" {
+		s.listen = "127.0.0.1:53"
+	}
+	s.domains = make(map[string]bool)
+	s.routes = make(map[string]*dnsRoute)
+	for _, file := range cfg.Bypass_domains {
+		if err := s.loadDomains(file, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range cfg.Include_domains {
+		if err := s.loadDomains(file, true); err != nil {
+			return nil, err
+		}
+	}
+
+	s.localDNS = cfg.Split_dns_upstream
+	if s.localDNS == "" {
+		host, _, _ := net.SplitHostPort(s.listen)
+		s.localDNS = systemNameserver(net.ParseIP(host))
+	}
+	if s.localDNS == "" {
+		return nil, errors.New("no upstream dns server for split-dns")
+	}
+	if _, _, err := net.SplitHostPort(s.localDNS); err != nil {
+		s.localDNS = net.JoinHostPort(s.localDNS, "53")
+	}
+	return s, nil
+}
+
+func (s *elSplitDNS) loadDomains(file string, tunnel bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		domain := strings.Trim(strings.ToLower(strings.TrimSpace(line)), ".")
+		if domain != "" {
+			s.domains[domain] = tunnel
+		}
+	}
+	return scanner.Err()
+}
+
+// first nameserver in resolv.conf that isn't us or a local stub like
+// systemd-resolved's 127.0.0.53, which would send the queries the
+// tunnel link gets back to us; resolved lists the uplinks' own
+// servers in a file of its own
+func systemNameserver(self net.IP) string {
+	for _, file := range []string{RESOLV_CONF, RESOLVED_RESOLV_CONF} {
+		if ns := readNameservers(file, self); len(ns) > 0 {
+			return ns[0].String()
+		}
+	}
+	return ""
+}
+
+// every such nameserver, of resolv.conf and resolved's
+func systemNameservers() []net.IP {
+	var servers []net.IP
+	for _, file := range []string{RESOLV_CONF, RESOLVED_RESOLV_CONF} {
+	next:
+		for _, ip := range readNameservers(file, nil) {
+			for _, other := range servers {
+				if ip.Equal(other) {
+					continue next
+				}
+			}
+			servers = append(servers, ip)
+		}
+	}
+	return servers
+}
+
+// the nameservers of a resolv.conf file but self and loopback ones
+func readNameservers(file string, self net.IP) []net.IP {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []net.IP
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) < 2 || tokens[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(tokens[1])
+		if ip != nil && !ip.Equal(self) && !ip.IsLoopback() {
+			servers = append(servers, ip)
+		}
+	}
+	return servers
+}
+
+// the system resolver only asks servers on port 53
+func checkSplitDNSListen(listen string) error {
+	if listen == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || net.ParseIP(host) == nil {
+		return fmt.Errorf("split-dns-listen %s: not an address and port", listen)
+	}
+	if port != "53" {
+		return fmt.Errorf("split-dns-listen %s: the system resolver only asks port 53", listen)
+	}
+	return nil
+}
+
+// whether name goes through the tunnel, the longest matching suffix
+// wins
+func (s *elSplitDNS) match(name string) (tunnel, found bool) {
+	name = strings.Trim(strings.ToLower(name), ".")
+	for {
+		if tunnel, found = s.domains[name]; found {
+			return tunnel, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return s.defaultTunnel, false
+		}
+		name = name[i+1:]
+	}
+}
+
+// serve on udp and tcp once the tunnel is up
+func (s *elSplitDNS) start(clt *ElClient) (net.IP, error) {
+	s.iface = clt.iface.Name()
+	s.peer = tun_peer
+	s.defaultTunnel = clt.cfg.Redirect_gateway
+	s.tunnelDNS = s.localDNS
+	if len(clt.dns) > 0 {
+		s.tunnelDNS = net.JoinHostPort(clt.dns[0].String(), "53")
+	}
+
+	uconn, err := net.ListenPacket("udp", s.listen)
+	if err != nil {
+		return nil, err
+	}
+	tln, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		uconn.Close()
+		return nil, err
+	}
+	logger.Info("split dns on %s, %d domains, upstreams %s and %s",
+		s.listen, len(s.domains), s.tunnelDNS, s.localDNS)
+
+	go s.serveUDP(uconn)
+	go s.serveTCP(tln)
+	go s.expire()
+	return uconn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func (s *elSplitDNS) serveUDP(conn net.PacketConn) {
+	for {
+		buf := make([]byte, SPLIT_DNS_MAX_LEN)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			logger.Error("split dns: %v", err)
+			return
+		}
+		go func() {
+			if resp := s.resolve(buf[:n], false); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *elSplitDNS) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Error("split dns: %v", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(SPLIT_DNS_TIMEOUT))
+			query, err := readTCPMsg(conn)
+			if err != nil {
+				return
+			}
+			if resp := s.resolve(query, true); resp != nil {
+				writeTCPMsg(conn, resp)
+			}
+		}()
+	}
+}
+
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// forward query to the upstream its name belongs to and route the
+// addresses in the answer before handing it back
+func (s *elSplitDNS) resolve(query []byte, tcp bool) []byte {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	tunnel, found := s.match(q.Name.String())
+	upstream := s.localDNS
+	if tunnel {
+		upstream = s.tunnelDNS
+	}
+
+	resp, err := exchangeDNS(upstream, query, tcp)
+	if err != nil {
+		logger.Debug("split dns %s: %v", q.Name, err)
+		return nil
+	}
+	if found {
+		s.routeAnswers(resp, tunnel)
+	}
+	return resp
+}
+
+func exchangeDNS(upstream string, query []byte, tcp bool) ([]byte, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, upstream, SPLIT_DNS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SPLIT_DNS_TIMEOUT))
+
+	if tcp {
+		if err = writeTCPMsg(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMsg(conn)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, SPLIT_DNS_MAX_LEN)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// address records in a response, cnames are followed by the upstream
+func parseAnswers(resp []byte) (ips []net.IP, ttls []time.Duration) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(resp); err != nil {
+		return nil, nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, nil
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		ttl := time.Duration(h.TTL) * time.Second
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return ips, ttls
+			}
+			ips, ttls = append(ips, net.IP(r.A[:])), append(ttls, ttl)
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return ips, ttls
+			}
+			ips, ttls = append(ips, net.IP(r.AAAA[:])), append(ttls, ttl)
+		default:
+			if err = p.SkipAnswer(); err != nil {
+				return ips, ttls
+			}
+		}
+	}
+	return ips, ttls
+}
+
+// route set of one family through the tunnel or around it
+func (s *elSplitDNS) routeSet(tunnel, v6 bool) *elRouteSet {
+	switch {
+	case tunnel && !v6:
+		return &elRouteSet{gw: s.peer, iface: s.iface}
+	case tunnel:
+		return &elRouteSet{iface: s.iface}
+	case !v6:
+		return &elRouteSet{gw: net.ParseIP(net_gateway), iface: net_nic}
+	default:
+		return &elRouteSet{gw: net.ParseIP(net_gateway6), iface: net_nic6}
+	}
+}
+
+func (s *elSplitDNS) routeAnswers(resp []byte, tunnel bool) {
+	ips, ttls := parseAnswers(resp)
+	now := time.Now()
+
+	var stale, fresh []*dnsRoute
+	add := make(map[bool]*elRouteSet)
+	s._lock.Lock()
+	for i, ip := range ips {
+		v6 := ip.To4() == nil
+		if v6 && !tunnel && net_gateway6 == "" {
+			continue
+		}
+		ttl := ttls[i]
+		if ttl < SPLIT_DNS_MIN_TTL {
+			ttl = SPLIT_DNS_MIN_TTL
+		}
+		key := ip.String()
+		if r, ok := s.routes[key]; ok {
+			if r.tunnel == tunnel {
+				if now.Add(ttl).After(r.expire) {
+					r.expire = now.Add(ttl)
+				}
+				continue
+			}
+			// the name that resolved to it last decides
+			stale = append(stale, r)
+		}
+		r := &dnsRoute{hostRoute(ip), tunnel, now.Add(ttl)}
+		s.routes[key] = r
+		fresh = append(fresh, r)
+		if add[v6] == nil {
+			add[v6] = s.routeSet(tunnel, v6)
+		}
+		add[v6].dests = append(add[v6].dests, r.dest)
+	}
+	s._lock.Unlock()
+
+	s.removeRoutes(stale)
+	added := make(map[*net.IPNet]bool)
+	for _, set := range add {
+		set.install()
+		for _, dest := range set.dests {
+			added[dest] = true
+		}
+	}
+
+	// forget the ones that failed, a route that was there already
+	// isn't ours to delete
+	s._lock.Lock()
+	for _, r := range fresh {
+		if key := r.dest.IP.String(); !added[r.dest] && s.routes[key] == r {
+			delete(s.routes, key)
+		}
+	}
+	s._lock.Unlock()
+}
+
+func (s *elSplitDNS) removeRoutes(routes []*dnsRoute) {
+	sets := make(map[[2]bool]*elRouteSet)
+	for _, r := range routes {
+		key := [2]bool{r.tunnel, r.dest.IP.To4() == nil}
+		if sets[key] == nil {
+			sets[key] = s.routeSet(key[0], key[1])
+		}
+		sets[key].dests = append(sets[key].dests, r.dest)
+	}
+	for _, set := range sets {
+		set.remove()
+	}
+}
+
+// drop the routes whose ttl ran out
+func (s *elSplitDNS) expire() {
+	for range time.Tick(10 * time.Second) {
+		now := time.Now()
+		var expired []*dnsRoute
+		s._lock.Lock()
+		for key, r := range s.routes {
+			if now.After(r.expire) {
+				expired = append(expired, r)
+				delete(s.routes, key)
+			}
+		}
+		s._lock.Unlock()
+		s.removeRoutes(expired)
+	}
+}
+
+// remove every route on exit
+func (s *elSplitDNS) cleanUp() {
+	s._lock.Lock()
+	routes := make([]*dnsRoute, 0, len(s.routes))
+	for key, r := range s.routes {
+		routes = append(routes, r)
+		delete(s.routes, key)
+	}
+	s._lock.Unlock()
+	s.removeRoutes(routes)
+}
@@ -0,0 +1,83 @@
+package el
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func Test_SplitDNS_Match(t *testing.T) {
+	s := new(elSplitDNS)
+	s.domains = map[string]bool{
+		"example.com":      true,
+		"cdn.example.com":  false,
+		"internal.example": true,
+	}
+	cases := []struct {
+		name          string
+		tunnel, found bool
+	}{
+		{"example.com.", true, true},
+		{"www.Example.com.", true, true},
+		{"img.cdn.example.com.", false, true},
+		{"notexample.com.", false, false},
+		{"internal.example", true, true},
+		{"example.", false, false},
+	}
+	for _, c := range cases {
+		tunnel, found := s.match(c.name)
+		if tunnel != c.tunnel || found != c.found {
+			t.Errorf("%s: got %v %v, want %v %v", c.name, tunnel, found, c.tunnel, c.found)
+		}
+	}
+}
+
+func Test_SplitDNS_Answers(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.com.")
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	b.CNAMEResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 300},
+		dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("edge.example.net.")})
+	b.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 30},
+		dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}})
+	b.AAAAResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 600},
+		dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}})
+	resp, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, ttls := parseAnswers(resp)
+	if len(ips) != 2 {
+		t.Fatalf("got %v, want 2 addresses", ips)
+	}
+	if !ips[0].Equal(net.ParseIP("192.0.2.10")) || ttls[0] != 30*time.Second {
+		t.Errorf("got %v %v", ips[0], ttls[0])
+	}
+	if !ips[1].Equal(net.ParseIP("2001:db8::1")) || ttls[1] != 600*time.Second {
+		t.Errorf("got %v %v", ips[1], ttls[1])
+	}
+}
+
+func Test_SplitDNS_Upstream(t *testing.T) {
+	file := t.TempDir() + "/resolv.conf"
+	conf := "nameserver 127.0.0.53\nnameserver 127.0.0.1\nnameserver 192.0.2.53\n"
+	if err := os.WriteFile(file, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ns := readNameservers(file, net.ParseIP("127.0.0.1")); len(ns) != 1 || ns[0].String() != "192.0.2.53" {
+		t.Errorf("got %v, want 192.0.2.53", ns)
+	}
+
+	if err := checkSplitDNSListen("127.0.0.1:53"); err != nil {
+		t.Error(err)
+	}
+	if checkSplitDNSListen("127.0.0.1:5353") == nil {
+		t.Error("port 5353 accepted")
+	}
+}
@@ -0,0 +1,97 @@
+package el
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func newTapServer(c2c int) *ElServer {
+	srv := new(ElServer)
+	srv.tap = true
+	srv.c2c = c2c
+	srv.sessionTable = make(map[uint64]*ElPeer)
+	srv.macs = make(map[uint64]*ElPeer)
+	srv.toIface = []*elQueue{newElQueue("toIface", 8, QUEUE_DROP_TAIL)}
+	return srv
+}
+
+// a working peer without its forwarding goroutine, so the
+// test can look at what's queued to it
+func newTapPeer(srv *ElServer, n int, mac string) *ElPeer {
+	hpeer := new(ElPeer)
+	hpeer.id = uint64(n) << 32
+	hpeer.state = HOP_STAT_WORKING
+	hpeer.fromIface = newElQueue(fmt.Sprintf("peer[%d]", n), 8, QUEUE_DROP_TAIL)
+	srv.sessionTable[hpeer.id] = hpeer
+	hw, _ := net.ParseMAC(mac)
+	srv.macs[mac2uint64(hw)] = hpeer
+	return hpeer
+}
+
+func tapFrame(dst, src string) []byte {
+	frame := make([]byte, ETH_HDR_LEN+20)
+	d, _ := net.ParseMAC(dst)
+	s, _ := net.ParseMAC(src)
+	copy(frame, d)
+	copy(frame[6:], s)
+	frame[12], frame[13] = 0x08, 0x00
+	return frame
+}
+
+func Test_Tap_Broadcast(t *testing.T) {
+	const macA, macB = "02:00:00:00:00:0a", "02:00:00:00:00:0b"
+	for _, c2c := range []int{C2C_KERNEL, C2C_DIRECT, C2C_DENY} {
+		srv := newTapServer(c2c)
+		a := newTapPeer(srv, 1, macA)
+		b := newTapPeer(srv, 2, macB)
+
+		srv.toDevice(a.id, &ElPacket{payload: tapFrame("ff:ff:ff:ff:ff:ff", macA)})
+		if srv.toIface[0].Len() != 1 {
+			t.Errorf("c2c %d: broadcast didn't reach the device", c2c)
+		}
+		if a.fromIface.Len() != 0 {
+			t.Errorf("c2c %d: broadcast went back to its sender", c2c)
+		}
+		want := 1
+		if c2c == C2C_DENY {
+			want = 0
+		}
+		if b.fromIface.Len() != want {
+			t.Errorf("c2c %d: peer B got %d copies of the broadcast, want %d", c2c, b.fromIface.Len(), want)
+		}
+		if want == 1 {
+			pack := b.fromIface.Pop().([]byte)
+			if mac := net.HardwareAddr(pack[HOP_HDR_LEN+6 : HOP_HDR_LEN+12]).String(); mac != macA {
+				t.Errorf("c2c %d: peer B got a frame from %s", c2c, mac)
+			}
+		}
+	}
+}
+
+func Test_Tap_Unicast(t *testing.T) {
+	const macA, macB = "02:00:00:00:00:0a", "02:00:00:00:00:0b"
+	for _, c2c := range []int{C2C_KERNEL, C2C_DIRECT, C2C_DENY} {
+		srv := newTapServer(c2c)
+		a := newTapPeer(srv, 1, macA)
+		b := newTapPeer(srv, 2, macB)
+
+		srv.toDevice(a.id, &ElPacket{payload: tapFrame(macB, macA)})
+		if srv.toIface[0].Len() != 0 {
+			t.Errorf("c2c %d: frame to a known peer went to the device", c2c)
+		}
+		want := 1
+		if c2c == C2C_DENY {
+			want = 0
+		}
+		if b.fromIface.Len() != want {
+			t.Errorf("c2c %d: peer B got %d frames, want %d", c2c, b.fromIface.Len(), want)
+		}
+
+		// unknown destinations are left to the device
+		srv.toDevice(a.id, &ElPacket{payload: tapFrame("02:00:00:00:00:0c", macA)})
+		if srv.toIface[0].Len() != 1 {
+			t.Errorf("c2c %d: frame to an unknown mac didn't reach the device", c2c)
+		}
+	}
+}
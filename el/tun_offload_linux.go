@@ -0,0 +1,163 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Mahmoud Abdelsalam <scroveez@gmail.com>
+ *
+ */
+
+// tun device with IFF_VNET_HDR and TSO/USO offloads
+
+package el
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// not in x/sys yet, linux >= 6.2
+	TUN_F_USO4 = 0x20
+	TUN_F_USO6 = 0x40
+)
+
+// vnetTun reads super packets of up to 64k and hands them out one
+// segment at a time, and coalesces what it writes back into super
+// packets where it can
+type vnetTun struct {
+	fd   int
+	name string
+	rbuf []byte
+	// segments of the last super packet not read yet
+	segs [][]byte
+	next int
+
+	whdr [VNET_HDR_LEN]byte
+	gro  []groPacket
+	iovs [][]byte
+}
+
+func openVnetTun(name string, multiQueue bool) (*vnetTun, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	flags := uint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR)
+	if multiQueue {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+	ifr.SetUint16(flags)
+	if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	offload := unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6
+	if err = unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, offload|TUN_F_USO4|TUN_F_USO6); err != nil {
+		// older kernels know nothing about USO
+		logger.Debug("USO offload unavailable: %v", err)
+		if err = unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, offload); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+
+	t := new(vnetTun)
+	t.fd = fd
+	t.name = ifr.Name()
+	t.rbuf = make([]byte, VNET_HDR_LEN+GSO_MAX_SIZE)
+	return t, nil
+}
+
+func (t *vnetTun) Name() string {
+	return t.name
+}
+
+func (t *vnetTun) Close() error {
+	return unix.Close(t.fd)
+}
+
+// Read returns one ip packet per call, segmenting super packets
+func (t *vnetTun) Read(b []byte) (int, error) {
+	for {
+		if t.next < len(t.segs) {
+			seg := t.segs[t.next]
+			t.segs[t.next] = nil
+			t.next++
+			n := copy(b, seg)
+			putBuffer(seg)
+			return n, nil
+		}
+
+		n, err := unix.Read(t.fd, t.rbuf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return 0, err
+		}
+		if n < VNET_HDR_LEN {
+			continue
+		}
+
+		var h vnetHdr
+		h.decode(t.rbuf)
+		pkt := t.rbuf[VNET_HDR_LEN:n]
+
+		if h.gsoType == VNET_HDR_GSO_NONE {
+			if h.flags&VNET_HDR_F_NEEDS_CSUM != 0 {
+				if err := completeChecksum(pkt, &h); err != nil {
+					continue
+				}
+			}
+			return copy(b, pkt), nil
+		}
+
+		t.segs, t.next = t.segs[:0], 0
+		t.segs, err = gsoSplit(pkt, &h, t.segs)
+		if err != nil {
+			logger.Debug("dropping super packet: %v", err)
+		}
+	}
+}
+
+// Write a single packet, without any offload
+func (t *vnetTun) Write(b []byte) (int, error) {
+	t.whdr = [VNET_HDR_LEN]byte{}
+	n, err := unix.Writev(t.fd, [][]byte{t.whdr[:], b})
+	if n >= VNET_HDR_LEN {
+		n -= VNET_HDR_LEN
+	}
+	return n, err
+}
+
+// WriteBatch writes packets, merging tcp segments into super packets
+func (t *vnetTun) WriteBatch(pkts [][]byte) error {
+	t.gro = groCoalesce(pkts, t.gro[:0])
+	for i := range t.gro {
+		gp := &t.gro[i]
+		gp.hdr.encode(t.whdr[:])
+		t.iovs = append(t.iovs[:0], t.whdr[:])
+		t.iovs = append(t.iovs, gp.parts...)
+		if _, err := unix.Writev(t.fd, t.iovs); err != nil {
+			return err
+		}
+		gp.parts = nil
+	}
+	return nil
+}
@@ -28,7 +28,7 @@ import (
 	. "github.com/scroveez/elvpn/internal"
 )
 
-var srvMode, cltMode, debug, getVersion bool
+var srvMode, cltMode, debug, getVersion, disconnect, dryRun bool
 var cfgFile string
 
 var VERSION = "0.0.1"
@@ -37,6 +37,8 @@ func main() {
 	flag.BoolVar(&getVersion, "version", false, "Get Version info")
 	flag.BoolVar(&debug, "debug", false, "Provide debug info")
 	flag.StringVar(&cfgFile, "config", "", "configfile")
+	flag.BoolVar(&disconnect, "disconnect", false, "Lift the kill switch left by a client and exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the firewall rules the server would set up and exit")
 	flag.Parse()
 
 	if getVersion {
@@ -56,6 +58,11 @@ func main() {
 		}
 	}
 
+	if disconnect {
+		checkerr(el.DisableKillSwitch())
+		os.Exit(0)
+	}
+
 	if cfgFile == "" {
 		cfgFile = flag.Arg(0)
 	}
@@ -66,6 +73,11 @@ func main() {
 	logger.Debug("%v", icfg)
 	checkerr(err)
 
+	if dryRun {
+		checkerr(el.DryRun(icfg))
+		os.Exit(0)
+	}
+
 	maxProcs := runtime.GOMAXPROCS(0)
 	if maxProcs < 2 {
 		runtime.GOMAXPROCS(2)
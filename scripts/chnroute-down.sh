@@ -1,4 +1,5 @@
 #!/bin/bash
+# deprecated, bypass-routes = chnroute.txt in client.ini adds the same routes
 export PATH="/bin:/sbin:/usr/sbin:/usr/bin"
 
 OLDGW=$(cat /tmp/vpn_oldgw)
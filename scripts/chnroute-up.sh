@@ -1,4 +1,5 @@
 #!/bin/bash -
+# deprecated, bypass-routes = chnroute.txt in client.ini adds the same routes
 
 OLDGW=$(ip route show 0/0 | head -n1 | grep 'via' | grep -Po '\d+\.\d+\.\d+\.\d+')
 